@@ -1,27 +1,104 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/abyii/zip-xxh3"
+
+	"t-sync/tracing"
 )
 
 type countingWriter struct {
-    writer io.Writer
-    total  int64
+    writer   io.Writer
+    total    int64
+    stats    *RunStats
 }
 
 func (cw *countingWriter) Write(p []byte) (n int, err error) {
     n, err = cw.writer.Write(p)
     cw.total += int64(n)
+    cw.stats.AddCompressed(n)
     return
 }
 
+// contextReader fails reads once ctx is cancelled, so an interrupt doesn't wait for a
+// large file to be compressed to the end. A read already blocked on a pipe is only
+// interrupted if the file supports deadlines, see interruptReads.
+type contextReader struct {
+    ctx    context.Context
+    reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+    if r.ctx.Err() != nil {
+        return 0, context.Cause(r.ctx)
+    }
+    n, err := r.reader.Read(p)
+    if err != nil && r.ctx.Err() != nil {
+        // the read was cut short by interruptReads
+        return n, context.Cause(r.ctx)
+    }
+    return n, err
+}
+
+// interruptReads makes a read of f that is blocked waiting for a writer return once ctx is
+// cancelled. It only works for files registered with the runtime poller: pipes and FIFOs
+// opened by path do, a blocking os.Stdin doesn't (see openStdin). stop must be called once
+// f is no longer read.
+func interruptReads(ctx context.Context, f *os.File) (stop func() bool) {
+    return context.AfterFunc(ctx, func() {
+        f.SetReadDeadline(time.Now())
+    })
+}
+
+// openStdin returns the file to read the stdin source from. A pipe is reopened through
+// /dev/stdin so that the new descriptor is non-blocking and interruptReads works on it;
+// os.Stdin itself is returned where that isn't possible. The caller closes the file
+// unless it is os.Stdin.
+func openStdin() *os.File {
+    info, err := os.Stdin.Stat()
+    if err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+        return os.Stdin
+    }
+    f, err := os.Open("/dev/stdin")
+    if err != nil {
+        slog.Debug("Can't reopen stdin, an interrupt waits for the next write", "error", err)
+        return os.Stdin
+    }
+    return f
+}
+
+// ArchiveOptions controls how entries are selected and written into the zip.
+type ArchiveOptions struct {
+    CompressionLevel int
+    Password         string
+    IgnoreFile       string
+    Filters          FilterOptions
+    Rewriter         *PathRewriter
+    Stats            *RunStats
+    ReadLimit        *BandwidthLimiter
+}
+
+// archiveEntry is a single file or directory picked up by the walk, ready to be added to a zip.
+type archiveEntry struct {
+    Path    string // path on disk
+    RelPath string // path inside the archive
+    Info    os.FileInfo
+}
+
+// streamed reports whether the entry is read from stdin or a named pipe: its size isn't
+// known up front and it can only be read once.
+func (e archiveEntry) streamed() bool {
+    return e.Path == StdinSource || e.Info.Mode()&os.ModeNamedPipe != 0
+}
+
 func openFileWithRetry(path string) (*os.File, error) {
     var file *os.File
     var err error
@@ -35,41 +112,88 @@ func openFileWithRetry(path string) (*os.File, error) {
     return nil, err
 }
 
-func CreateZipArchive(srcDir string, writer io.Writer, compressionLevel int, password string, ignoreFile string) error {
-
-    var ignorer IgnoreParser
-    if ignoreFile != "" {
-        gi, err := CompileIgnoreFile(ignoreFile)
+// walkSource walks a source and calls fn for every file and directory that is not ignored.
+// The source directory itself and non-regular files are skipped, except a named pipe given
+// as the source, which is streamed. Filters are matched against the path the entry will
+// have inside the archive, before any rewriting. Stdin isn't filtered.
+func walkSource(src ArchiveSource, filter *FilterChain, fn func(entry archiveEntry) error) error {
+    if src.Path == StdinSource {
+        info, err := os.Stdin.Stat()
         if err != nil {
-            return fmt.Errorf("failed to compile ignore file: %v", err)
+            return err
         }
-        ignorer = gi
+        return fn(archiveEntry{Path: StdinSource, RelPath: src.Prefix, Info: info})
     }
 
-    cw := &countingWriter{writer: writer}
-    zipWriter := zip.NewWriter(cw)
-
-    defer zipWriter.Close()
-    log.Printf("Creating zip archive for %s\n", srcDir)
-    totalUncompressed := int64(0)
+    // directories waiting for their first archived file, when the filter adds them lazily.
+    // The walk is depth first, so they are always the ancestors of the current path.
+    var pending []archiveEntry
+    dropPending := func(keep func(dir archiveEntry) bool) {
+        kept := pending[:0]
+        for _, dir := range pending {
+            if keep(dir) {
+                kept = append(kept, dir)
+                continue
+            }
+            const reason = "no file below it is included"
+            if filter.Explain && !filter.quiet {
+                slog.Info("Excluded", "file", dir.RelPath+"/", "reason", reason)
+            }
+            if filter.OnExclude != nil {
+                filter.OnExclude(dir.RelPath+"/", dir.Info, reason)
+            }
+        }
+        pending = kept
+    }
+    emit := func(entry archiveEntry) error {
+        if !filter.lazyDirs {
+            return fn(entry)
+        }
+        dropPending(func(dir archiveEntry) bool {
+            return strings.HasPrefix(entry.RelPath, dir.RelPath+string(filepath.Separator))
+        })
+        if entry.Info.IsDir() {
+            pending = append(pending, entry)
+            return nil
+        }
+        for _, dir := range pending {
+            if err := fn(dir); err != nil {
+                return err
+            }
+        }
+        pending = pending[:0]
+        return fn(entry)
+    }
 
-    err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+    err := filepath.Walk(src.Path, func(path string, info os.FileInfo, err error) error {
         if err != nil {
             return err
         }
 
-        relPath, err := filepath.Rel(srcDir, path)
+        relPath, err := filepath.Rel(src.Path, path)
         if err != nil {
             return err
         }
+        isRoot := relPath == "."
+        if info.IsDir() && isRoot {
+            return filter.EnterDir(path, src.archivePath(relPath, true))
+        }
+        relPath = src.archivePath(relPath, info.IsDir())
 
 		checkPath := relPath 
 		if info.IsDir() {
 			checkPath += "/" // for directories, we should check with a trailing slash
 		}
 
-		if ignorer != nil && ignorer.MatchesPath(checkPath) {
-			log.Printf("Ignoring %s\n", relPath)
+		if excluded, reason := filter.Excludes(checkPath, info); excluded {
+			if filter.Explain && !filter.quiet {
+				slog.Info("Excluded", "file", checkPath, "reason", reason)
+			} else if !filter.quiet {
+				slog.Debug("Ignoring", "file", relPath)
+			}
+			if filter.OnExclude != nil {
+				filter.OnExclude(checkPath, info, reason)
+			}
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
@@ -77,64 +201,212 @@ func CreateZipArchive(srcDir string, writer io.Writer, compressionLevel int, pas
 		}
 
         if info.IsDir() {
-            if relPath == "." {
-                return nil
-            }
-            
-            dirName := filepath.ToSlash(relPath)
-            if len(dirName) > 0 && dirName[len(dirName)-1] != '/' {
-                dirName += "/"
-            }
-
-            _, err := zipWriter.Create(dirName, zip.Store, 0, zip.NoEncryption, "")
-            if err != nil {
-                log.Printf("Failed to create zip entry for directory %s: %v\n", dirName, err)
+            if err := filter.EnterDir(path, relPath); err != nil {
                 return err
             }
-            log.Printf("Added directory %s\n", dirName)
+        } else if !info.Mode().IsRegular() && !(isRoot && info.Mode()&os.ModeNamedPipe != 0) {
             return nil
         }
 
-        if !info.Mode().IsRegular() {
-            return nil
-        }
+        return emit(archiveEntry{Path: path, RelPath: relPath, Info: info})
+    })
+    if err != nil {
+        return err
+    }
+    dropPending(func(archiveEntry) bool { return false })
+    return nil
+}
 
-        srcFile, err := openFileWithRetry(path)
+// walkSources walks every source in order, see walkSource. When several sources map to
+// the same archive path, only the first one is kept.
+func walkSources(sources []ArchiveSource, filter *FilterChain, fn func(entry archiveEntry) error) error {
+    if len(sources) == 1 {
+        return walkSource(sources[0], filter, fn)
+    }
+
+    seen := make(map[string]struct{})
+    for _, src := range sources {
+        err := walkSource(src, filter, func(entry archiveEntry) error {
+            if _, dup := seen[entry.RelPath]; dup {
+                slog.Warn("Skipping duplicate", "file", entry.RelPath, "path", entry.Path)
+                if filter.OnExclude != nil {
+                    filter.OnExclude(entry.RelPath, entry.Info, "duplicate of an earlier source")
+                }
+                return nil
+            }
+            seen[entry.RelPath] = struct{}{}
+            return fn(entry)
+        })
         if err != nil {
-            log.Printf("Failed to open file %s: %v\n", path, err)
             return err
         }
-        defer srcFile.Close()
+    }
+    return nil
+}
+
+// addEntryToZip writes a single walked entry into the zip and returns the number of uncompressed bytes added.
+// names holds the disk path of every entry already in the zip by name: a file rewritten to the name
+// of another entry is an error, a directory that was already added is skipped.
+func addEntryToZip(ctx context.Context, zipWriter *zip.Writer, entry archiveEntry, names map[string]string, opts ArchiveOptions) (written int64, err error) {
+    relPath := filepath.ToSlash(entry.RelPath)
+    if entry.Info.IsDir() {
+        relPath += "/"
+    }
+    name, err := opts.Rewriter.Rewrite(relPath)
+    if err != nil {
+        return 0, err
+    }
+    if name == "" {
+        slog.Debug("Skipping, path rewritten to nothing", "file", entry.RelPath)
+        opts.Stats.Skipped()
+        return 0, nil
+    }
+    if first, dup := names[name]; dup {
+        if entry.Info.IsDir() {
+            slog.Debug("Skipping directory, already added", "file", name, "path", entry.Path, "first", first)
+            return 0, nil
+        }
+        return 0, fmt.Errorf("%s and %s are both stored as %s", first, entry.Path, name)
+    }
+    names[name] = entry.Path
 
-        dynamicLevel := getCompressionLevelForFile(relPath, compressionLevel)
+    _, span := tracing.Start(ctx, "compress", tracing.String("file", name), tracing.Bool("dir", entry.Info.IsDir()))
+    defer func() {
+        span.SetAttributes(tracing.Int("bytes", written))
+        span.End(err)
+    }()
 
-        var entryWriter io.Writer
-        if password != "" {
-            entryWriter, err = zipWriter.Create(relPath, zip.Deflate, dynamicLevel, zip.StandardEncryption, password)
-        } else {
-            entryWriter, err = zipWriter.Create(relPath, zip.Deflate, dynamicLevel, zip.NoEncryption, "")
+    if entry.Info.IsDir() {
+        dirName := name
+        if !strings.HasSuffix(dirName, "/") {
+            dirName += "/"
         }
+
+        _, err := zipWriter.Create(dirName, zip.Store, 0, zip.NoEncryption, "")
         if err != nil {
-            log.Printf("Failed to create zip entry for file %s: %v\n", relPath, err)
-            return err
+            slog.Error("Failed to create zip entry for directory", "file", dirName, "error", err)
+            return 0, err
         }
+        slog.Debug("Added directory", "file", dirName)
+        opts.Stats.DirAdded()
+        return 0, nil
+    }
 
-        written, err := io.Copy(entryWriter, srcFile)
+    var srcFile *os.File
+    if entry.Path == StdinSource {
+        srcFile = openStdin()
+    } else {
+        srcFile, err = openFileWithRetry(entry.Path)
         if err != nil {
-            return err
+            slog.Error("Failed to open file", "file", entry.Path, "error", err)
+            return 0, err
         }
-        totalUncompressed += written
+    }
+    if srcFile != os.Stdin {
+        defer srcFile.Close()
+    }
+    if entry.streamed() {
+        slog.Info("Streaming entry", "file", name, "from", entry.Path)
+        defer interruptReads(ctx, srcFile)()
+    }
+
+    dynamicLevel := getCompressionLevelForFile(name, opts.CompressionLevel)
+
+    var entryWriter io.Writer
+    if opts.Password != "" {
+        entryWriter, err = zipWriter.Create(name, zip.Deflate, dynamicLevel, zip.StandardEncryption, opts.Password)
+    } else {
+        entryWriter, err = zipWriter.Create(name, zip.Deflate, dynamicLevel, zip.NoEncryption, "")
+    }
+    if err != nil {
+        slog.Error("Failed to create zip entry for file", "file", name, "error", err)
+        return 0, err
+    }
+
+    written, err = io.Copy(entryWriter, opts.Stats.TrackReads(opts.ReadLimit.LimitReader(ctx, &contextReader{ctx: ctx, reader: srcFile})))
+    if err != nil {
+        return written, err
+    }
+    opts.Stats.FileAdded()
+
+    slog.Debug("Added", "file", name, "bytes", written)
+    return written, nil
+}
+
+func CreateZipArchive(ctx context.Context, sources []ArchiveSource, writer io.Writer, opts ArchiveOptions) (err error) {
+
+    filter, err := NewFilterChain(opts.IgnoreFile, opts.Filters)
+    if err != nil {
+        return err
+    }
+    filter.OnExclude = func(path string, info os.FileInfo, reason string) {
+        opts.Stats.Excluded()
+    }
+
+    opts.Stats.StageStart("archive")
+    defer opts.Stats.StageEnd("archive")
 
-        log.Printf("Added %s (%d bytes)\n", relPath, written)
-        return nil
+    ctx, span := tracing.Start(ctx, "walk", tracing.Int("sources", int64(len(sources))))
+    defer func() { span.End(err) }()
+
+    cw := &countingWriter{writer: writer, stats: opts.Stats}
+    zipWriter := zip.NewWriter(cw)
+
+    for _, src := range sources {
+        slog.Info("Creating zip archive", "source", src.Path)
+    }
+    totalUncompressed := int64(0)
+    names := make(map[string]string)
+
+    err = walkSources(sources, filter, func(entry archiveEntry) error {
+        if ctx.Err() != nil {
+            return context.Cause(ctx)
+        }
+        written, err := addEntryToZip(ctx, zipWriter, entry, names, opts)
+        totalUncompressed += written
+        return err
     })
 
     if err != nil {
-        return fmt.Errorf("walk error: %v", err)
+        return fmt.Errorf("walk error: %w", err)
     }
 
-    log.Printf("Total uncompressed size: %d MiB\n", totalUncompressed/KiB/KiB) // Convert to MiB
-    log.Printf("Total compressed size: %d MiB\n", cw.total/KiB/KiB)              // Convert to MiB
+    // the central directory and whatever the zip writer still buffers are only written by Close
+    if err := zipWriter.Close(); err != nil {
+        return fmt.Errorf("failed to finish zip archive: %w", err)
+    }
+    slog.Info("Zip archive created", "uncompressed_bytes", totalUncompressed, "compressed_bytes", cw.total)
+
+    return nil
+}
+
+// CreateZipArchiveFromEntries writes an already planned list of entries (e.g. a shard) into a zip.
+func CreateZipArchiveFromEntries(ctx context.Context, name string, entries []archiveEntry, writer io.Writer, opts ArchiveOptions) error {
+    opts.Stats.StageStart("archive")
+    defer opts.Stats.StageEnd("archive")
+
+    cw := &countingWriter{writer: writer, stats: opts.Stats}
+    zipWriter := zip.NewWriter(cw)
+
+    slog.Info("Creating zip archive", "shard", name, "entries", len(entries))
+    totalUncompressed := int64(0)
+    names := make(map[string]string)
+
+    for _, entry := range entries {
+        if ctx.Err() != nil {
+            return context.Cause(ctx)
+        }
+        written, err := addEntryToZip(ctx, zipWriter, entry, names, opts)
+        totalUncompressed += written
+        if err != nil {
+            return fmt.Errorf("failed to add %s: %w", entry.RelPath, err)
+        }
+    }
+
+    if err := zipWriter.Close(); err != nil {
+        return fmt.Errorf("failed to finish zip archive: %w", err)
+    }
+    slog.Info("Zip archive created", "shard", name, "uncompressed_bytes", totalUncompressed, "compressed_bytes", cw.total)
 
     return nil
 }
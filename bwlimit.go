@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bandwidthRule sets the rate from a time of day until the next rule.
+type bandwidthRule struct {
+    start int   // minutes since midnight, local time
+    rate  int64 // bytes per second, 0 for unlimited
+}
+
+// BandwidthLimiter is a token bucket shared by all the goroutines that read or upload
+// data. The bucket holds at most one second worth of tokens. A wait larger than the
+// bucket takes it into debt, so the next caller waits until the debt is repaid: the
+// average rate is kept whatever the size of the chunks. A nil limiter doesn't limit.
+type BandwidthLimiter struct {
+    schedule []bandwidthRule // sorted by start
+
+    // turn lets a single caller wait for tokens at a time, in arrival order
+    turn   chan struct{}
+    mu     sync.Mutex
+    rate   int64
+    tokens float64
+    last   time.Time
+}
+
+// ParseBandwidthLimit parses a rate like "50MiB/s" (the "/s" is optional, "off" or 0 for
+// unlimited) or a timetable of "HH:MM,rate" entries separated by spaces, e.g.
+// "08:00,10MiB/s 18:00,off". Each entry applies until the next one and the last one
+// wraps around midnight. Returns nil when there is no limit at any time.
+func ParseBandwidthLimit(value string) (*BandwidthLimiter, error) {
+    value = strings.TrimSpace(value)
+    if value == "" {
+        return nil, nil
+    }
+
+    var schedule []bandwidthRule
+    if !strings.Contains(value, ",") {
+        rate, err := parseRate(value)
+        if err != nil {
+            return nil, err
+        }
+        schedule = []bandwidthRule{{start: 0, rate: rate}}
+    } else {
+        for _, entry := range strings.Fields(value) {
+            at, rateStr, ok := strings.Cut(entry, ",")
+            if !ok {
+                return nil, fmt.Errorf("invalid timetable entry %q, expected HH:MM,rate", entry)
+            }
+            start, err := time.Parse("15:04", at)
+            if err != nil {
+                return nil, fmt.Errorf("invalid time %q in timetable entry %q, expected HH:MM", at, entry)
+            }
+            rate, err := parseRate(rateStr)
+            if err != nil {
+                return nil, err
+            }
+            schedule = append(schedule, bandwidthRule{start: start.Hour()*60 + start.Minute(), rate: rate})
+        }
+        sort.SliceStable(schedule, func(i, j int) bool { return schedule[i].start < schedule[j].start })
+    }
+
+    limited := false
+    for _, rule := range schedule {
+        limited = limited || rule.rate > 0
+    }
+    if !limited {
+        return nil, nil
+    }
+    return &BandwidthLimiter{schedule: schedule, turn: make(chan struct{}, 1)}, nil
+}
+
+// parseRate parses a rate in bytes per second like "50MiB/s", "512K" or "off".
+func parseRate(value string) (int64, error) {
+    s := strings.TrimSpace(value)
+    if strings.EqualFold(s, "off") {
+        return 0, nil
+    }
+    s = strings.TrimSuffix(strings.TrimSuffix(s, "/s"), "/S")
+    rate, err := parseByteSize(s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid rate %q", value)
+    }
+    return rate, nil
+}
+
+// rateAt returns the rate of the schedule at the given time.
+func (l *BandwidthLimiter) rateAt(now time.Time) int64 {
+    minute := now.Hour()*60 + now.Minute()
+    // before the first entry of the day, the last entry of the previous day applies
+    rate := l.schedule[len(l.schedule)-1].rate
+    for _, rule := range l.schedule {
+        if rule.start > minute {
+            break
+        }
+        rate = rule.rate
+    }
+    return rate
+}
+
+// refill adds the tokens earned since the last call and returns the current rate.
+// The caller holds mu.
+func (l *BandwidthLimiter) refill(now time.Time) int64 {
+    rate := l.rateAt(now)
+    if rate != l.rate {
+        if l.rate == 0 {
+            // start with a full bucket after an unlimited period
+            l.tokens = float64(rate)
+        }
+        if rate == 0 {
+            slog.Info("Bandwidth limit lifted")
+        } else {
+            slog.Info("Bandwidth limit changed", "bytes_per_second", rate)
+        }
+        l.rate = rate
+    } else if rate > 0 {
+        l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+    }
+    if l.tokens > float64(rate) {
+        l.tokens = float64(rate)
+    }
+    l.last = now
+    return rate
+}
+
+// WaitN blocks until n bytes may be transferred under the current limit, or ctx is done.
+func (l *BandwidthLimiter) WaitN(ctx context.Context, n int) error {
+    if l == nil || n <= 0 {
+        return nil
+    }
+
+    select {
+    case l.turn <- struct{}{}:
+    case <-ctx.Done():
+        return context.Cause(ctx)
+    }
+    defer func() { <-l.turn }()
+
+    for {
+        l.mu.Lock()
+        rate := l.refill(time.Now())
+        if rate == 0 || l.tokens >= 0 {
+            l.tokens -= float64(n)
+            l.mu.Unlock()
+            return nil
+        }
+        wait := time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+        l.mu.Unlock()
+
+        // wake up at least every second to pick up a change of the schedule
+        if wait > time.Second {
+            wait = time.Second
+        }
+        select {
+        case <-time.After(wait):
+        case <-ctx.Done():
+            return context.Cause(ctx)
+        }
+    }
+}
+
+// limitedReadChunk caps a single read of a limitedReader, so a large read is paid for in
+// small steps instead of a burst followed by a long wait.
+const limitedReadChunk = 128 * KiB
+
+// limitedReader throttles reads to the rate of a BandwidthLimiter.
+type limitedReader struct {
+    ctx     context.Context
+    limiter *BandwidthLimiter
+    reader  io.Reader
+}
+
+// LimitReader returns a reader that is throttled by the limiter, or r itself when the
+// limiter is nil.
+func (l *BandwidthLimiter) LimitReader(ctx context.Context, r io.Reader) io.Reader {
+    if l == nil {
+        return r
+    }
+    return &limitedReader{ctx: ctx, limiter: l, reader: r}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+    if len(p) > limitedReadChunk {
+        p = p[:limitedReadChunk]
+    }
+    n, err := r.reader.Read(p)
+    if n > 0 {
+        if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+            return n, waitErr
+        }
+    }
+    return n, err
+}
+
+// limitedReadSeeker is a limitedReader that can be rewound, for request bodies that are
+// sent again when a call is retried. Every attempt pays for the bytes it sends.
+type limitedReadSeeker struct {
+    limitedReader
+    seeker io.Seeker
+}
+
+// LimitReadSeeker is LimitReader for a request body, see limitedReadSeeker.
+func (l *BandwidthLimiter) LimitReadSeeker(ctx context.Context, rs io.ReadSeeker) io.ReadSeeker {
+    if l == nil {
+        return rs
+    }
+    return &limitedReadSeeker{limitedReader: limitedReader{ctx: ctx, limiter: l, reader: rs}, seeker: rs}
+}
+
+func (r *limitedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+    return r.seeker.Seek(offset, whence)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidthLimit(t *testing.T) {
+    tests := []struct {
+        in       string
+        schedule []bandwidthRule // nil when unlimited
+        wantErr  bool
+    }{
+        {"", nil, false},
+        {"off", nil, false},
+        {"0", nil, false},
+        {"50MiB/s", []bandwidthRule{{0, 50 * KiB * KiB}}, false},
+        {"512K", []bandwidthRule{{0, 512 * KiB}}, false},
+        {"1MB/S", []bandwidthRule{{0, 1000 * 1000}}, false},
+        {"08:00,10MiB/s 18:00,off", []bandwidthRule{{8 * 60, 10 * KiB * KiB}, {18 * 60, 0}}, false},
+        // entries are sorted by time
+        {"18:30,off 07:15,1M", []bandwidthRule{{7*60 + 15, KiB * KiB}, {18*60 + 30, 0}}, false},
+        {"08:00,off 18:00,off", nil, false},
+        {"fast", nil, true},
+        {"-5M", nil, true},
+        {"NaN", nil, true},
+        {"08:00", nil, true},
+        {"8am,10M", nil, true},
+        {"25:00,10M", nil, true},
+        {"08:00,10M 18:00", nil, true},
+        {"08:00,lots", nil, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.in, func(t *testing.T) {
+            limiter, err := ParseBandwidthLimit(tt.in)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+            }
+            if tt.schedule == nil {
+                if limiter != nil {
+                    t.Fatalf("got schedule %v, want no limit", limiter.schedule)
+                }
+                return
+            }
+            if limiter == nil {
+                t.Fatalf("got no limit, want %v", tt.schedule)
+            }
+            if !reflect.DeepEqual(limiter.schedule, tt.schedule) {
+                t.Errorf("schedule = %v, want %v", limiter.schedule, tt.schedule)
+            }
+        })
+    }
+}
+
+func TestBandwidthLimiterRateAt(t *testing.T) {
+    limiter, err := ParseBandwidthLimit("08:00,10M 18:00,off 22:00,1M")
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        at   string
+        want int64
+    }{
+        // before the first entry, the last one of the previous day applies
+        {"00:00", KiB * KiB},
+        {"07:59", KiB * KiB},
+        {"08:00", 10 * KiB * KiB},
+        {"17:59", 10 * KiB * KiB},
+        {"18:00", 0},
+        {"22:30", KiB * KiB},
+    }
+    for _, tt := range tests {
+        at, _ := time.ParseInLocation("15:04", tt.at, time.Local)
+        if got := limiter.rateAt(at); got != tt.want {
+            t.Errorf("rateAt(%s) = %d, want %d", tt.at, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"t-sync/storage_clients"
+)
+
+// CleanupCommand is the name of the subcommand that aborts orphaned multipart uploads.
+const CleanupCommand = "cleanup"
+
+// CleanupConfig holds the flags of the cleanup command.
+type CleanupConfig struct {
+    Destination *url.URL
+    AuthType    string
+    OlderThan   time.Time
+    Abort       bool
+    LogFormat   string
+    LogLevel    string
+    RetryPolicy storage_clients.RetryPolicy
+}
+
+// ParseCleanupFlags parses the flags of `t-sync cleanup`.
+func ParseCleanupFlags(args []string) (*CleanupConfig, error) {
+    cfg := &CleanupConfig{}
+    flags := flag.NewFlagSet(CleanupCommand, flag.ExitOnError)
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "Usage: %s %s -d <bucket/prefix URI> [flags]\n\nLists in-progress multipart uploads under a prefix and, with -abort, aborts them.\n\n", os.Args[0], CleanupCommand)
+        flags.PrintDefaults()
+    }
+
+    var destStr, olderThan string
+    flags.StringVar(&destStr, "d", "", "Bucket and key prefix to clean up (e.g., s3://bucket/backups/, oci://namespace@bucket/backups/).")
+    flags.StringVar(&cfg.AuthType, "auth-type", "", "Authentication type, as for an upload.")
+    flags.StringVar(&olderThan, "older-than", "24h", "Only uploads initiated before this time: an age like 24h or 7d, or a timestamp like 2026-10-17. Keeps uploads of running jobs out of the way.")
+    flags.BoolVar(&cfg.Abort, "abort", false, "Abort the listed uploads. Without it the uploads are only listed.")
+    flags.StringVar(&cfg.LogFormat, "log-format", LogFormatText, "Log format on stderr: text or json.")
+    flags.StringVar(&cfg.LogLevel, "log-level", "info", "Log level: debug, info, warn or error.")
+    addRetryFlags(flags, &cfg.RetryPolicy)
+    flags.Parse(args)
+
+    if destStr == "" {
+        flags.Usage()
+        return nil, fmt.Errorf("destination is required")
+    }
+    destURL, err := url.Parse(destStr)
+    if err != nil {
+        flags.Usage()
+        return nil, fmt.Errorf("invalid destination URI: %v", err)
+    }
+    cfg.Destination = destURL
+
+    if err := validateRetryPolicy(cfg.RetryPolicy); err != nil {
+        flags.Usage()
+        return nil, err
+    }
+
+    if cfg.OlderThan, err = parseTimeOrAge(olderThan, time.Now()); err != nil {
+        flags.Usage()
+        return nil, fmt.Errorf("invalid older-than: %v", err)
+    }
+    return cfg, nil
+}
+
+// RunCleanup lists the multipart uploads under the prefix that were initiated before
+// cfg.OlderThan, and aborts them when cfg.Abort is set. It returns an exit code.
+func RunCleanup(ctx context.Context, cfg *CleanupConfig, out io.Writer) (int, error) {
+    details, err := ParseDestURL(cfg.Destination)
+    if err != nil {
+        return ExitCodeInvalidParameters, err
+    }
+    if details.IsLocal() {
+        return ExitCodeInvalidParameters, fmt.Errorf("cleanup needs an object storage destination, local files have no multipart uploads")
+    }
+
+    uploader, err := NewUploader(details, cfg.AuthType)
+    if err != nil {
+        return ExitCodeUploaderClientFailed, fmt.Errorf("failed to create uploader: %v", err)
+    }
+    manager, ok := uploader.(MultipartUploadManager)
+    if !ok {
+        return ExitCodeInvalidParameters, fmt.Errorf("provider '%s' can't list multipart uploads", details.Provider)
+    }
+    return cleanupUploads(ctx, manager, details.Key, cfg, out)
+}
+
+// cleanupUploads lists the multipart uploads under prefix, prints those initiated before
+// cfg.OlderThan and aborts them when cfg.Abort is set. It returns an exit code.
+func cleanupUploads(ctx context.Context, manager MultipartUploadManager, prefix string, cfg *CleanupConfig, out io.Writer) (int, error) {
+    uploads, err := manager.ListMultipartUploads(ctx, prefix)
+    if err != nil {
+        return ExitCodeUploadFailed, err
+    }
+
+    var orphaned []storage_clients.MultipartUpload
+    for _, upload := range uploads {
+        if upload.Initiated.Before(cfg.OlderThan) {
+            orphaned = append(orphaned, upload)
+        }
+    }
+    slog.Info("Listed multipart uploads", "prefix", prefix, "uploads", len(uploads), "older", len(orphaned), "older_than", cfg.OlderThan.Format(time.RFC3339))
+
+    now := time.Now()
+    table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(table, "INITIATED\tAGE\tKEY\tUPLOAD ID")
+    for _, upload := range orphaned {
+        age := now.Sub(upload.Initiated).Truncate(time.Minute)
+        fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", upload.Initiated.Format(time.RFC3339), age, upload.Key, upload.UploadID)
+    }
+    table.Flush()
+
+    if !cfg.Abort {
+        if len(orphaned) > 0 {
+            slog.Info("Dry run, nothing aborted. Run again with -abort to abort these uploads", "uploads", len(orphaned))
+        }
+        return 0, nil
+    }
+
+    var failed int
+    for _, upload := range orphaned {
+        if err := manager.AbortMultipartUpload(ctx, upload.Key, upload.UploadID); err != nil {
+            slog.Error("Failed to abort multipart upload", "key", upload.Key, "upload_id", upload.UploadID, "error", err)
+            failed++
+        }
+    }
+    slog.Info("Aborted multipart uploads", "aborted", len(orphaned)-failed, "failed", failed)
+    if failed > 0 {
+        return ExitCodeUploadFailed, fmt.Errorf("failed to abort %d of %d uploads", failed, len(orphaned))
+    }
+    return 0, nil
+}
+
+// runCleanupCommand is the entry point of `t-sync cleanup`.
+func runCleanupCommand(args []string) {
+    cfg, err := ParseCleanupFlags(args)
+    if err != nil {
+        exitWithErrorCode(ExitCodeInvalidParameters, "Configuration error: %v", err)
+    }
+    if err := setupLogging(os.Stderr, cfg.LogFormat, cfg.LogLevel, false); err != nil {
+        exitWithErrorCode(ExitCodeInvalidParameters, "Configuration error: %v", err)
+    }
+
+    storage_clients.SetRetryPolicy(cfg.RetryPolicy)
+
+    ctx, stopSignals := withSignals(context.Background())
+    defer stopSignals()
+    if code, err := RunCleanup(ctx, cfg, os.Stdout); err != nil {
+        exitWithErrorCode(code, "Cleanup failed: %v", err)
+    }
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"t-sync/storage_clients"
+)
+
+// fakeUploadManager lists its uploads under a prefix like the storage services do and
+// records the aborted keys, failing the aborts of the keys in failAbort.
+type fakeUploadManager struct {
+    uploads   []storage_clients.MultipartUpload
+    failAbort map[string]bool
+    listErr   error
+
+    listedPrefix string
+    aborted      []string
+}
+
+func (m *fakeUploadManager) ListMultipartUploads(ctx context.Context, prefix string) ([]storage_clients.MultipartUpload, error) {
+    m.listedPrefix = prefix
+    if m.listErr != nil {
+        return nil, m.listErr
+    }
+    var uploads []storage_clients.MultipartUpload
+    for _, upload := range m.uploads {
+        if strings.HasPrefix(upload.Key, prefix) {
+            uploads = append(uploads, upload)
+        }
+    }
+    return uploads, nil
+}
+
+func (m *fakeUploadManager) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+    if m.failAbort[key] {
+        return errors.New("access denied")
+    }
+    m.aborted = append(m.aborted, key)
+    return nil
+}
+
+func TestCleanupSelection(t *testing.T) {
+    now := time.Now()
+    upload := func(key string, age time.Duration) storage_clients.MultipartUpload {
+        return storage_clients.MultipartUpload{Key: key, UploadID: "id-" + key, Initiated: now.Add(-age)}
+    }
+    uploads := []storage_clients.MultipartUpload{
+        upload("backups/app.zip", 48*time.Hour),
+        upload("backups/app-2.zip", time.Hour),
+        upload("backups/db/dump.zip", 10*24*time.Hour),
+        upload("backups-old/app.zip", 48*time.Hour),
+        upload("other/app.zip", 30*time.Hour),
+    }
+
+    tests := []struct {
+        name       string
+        args       []string
+        wantPrefix string
+        want       []string
+    }{
+        {"default age", []string{"-d", "s3://bucket/backups/"}, "backups/",
+            []string{"backups/app.zip", "backups/db/dump.zip"}},
+        {"age in days", []string{"-d", "s3://bucket/backups/", "-older-than", "7d"}, "backups/",
+            []string{"backups/db/dump.zip"}},
+        {"timestamp", []string{"-d", "s3://bucket/backups/", "-older-than", now.Add(-30 * time.Minute).Format(time.RFC3339)}, "backups/",
+            []string{"backups/app-2.zip", "backups/app.zip", "backups/db/dump.zip"}},
+        {"prefix without a slash", []string{"-d", "s3://bucket/backups"}, "backups",
+            []string{"backups-old/app.zip", "backups/app.zip", "backups/db/dump.zip"}},
+        {"whole bucket", []string{"-d", "oci://ns@bucket", "-older-than", "36h"}, "",
+            []string{"backups-old/app.zip", "backups/app.zip", "backups/db/dump.zip"}},
+        {"nothing old enough", []string{"-d", "s3://bucket/other/", "-older-than", "2d"}, "other/", nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg, err := ParseCleanupFlags(tt.args)
+            if err != nil {
+                t.Fatal(err)
+            }
+            details, err := ParseDestURL(cfg.Destination)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            // without -abort the selection is only listed
+            manager := &fakeUploadManager{uploads: uploads}
+            var out bytes.Buffer
+            if code, err := cleanupUploads(context.Background(), manager, details.Key, cfg, &out); code != 0 || err != nil {
+                t.Fatalf("cleanupUploads() = %d, %v", code, err)
+            }
+            if manager.listedPrefix != tt.wantPrefix {
+                t.Errorf("listed prefix %q, want %q", manager.listedPrefix, tt.wantPrefix)
+            }
+            if len(manager.aborted) != 0 {
+                t.Errorf("aborted %q without -abort", manager.aborted)
+            }
+            for _, upload := range uploads {
+                listed := strings.Contains(out.String(), "id-"+upload.Key)
+                if want := slices.Contains(tt.want, upload.Key); listed != want {
+                    t.Errorf("%s listed = %v, want %v\n%s", upload.Key, listed, want, out.String())
+                }
+            }
+
+            cfg.Abort = true
+            manager = &fakeUploadManager{uploads: uploads}
+            if code, err := cleanupUploads(context.Background(), manager, details.Key, cfg, &bytes.Buffer{}); code != 0 || err != nil {
+                t.Fatalf("cleanupUploads() with -abort = %d, %v", code, err)
+            }
+            sort.Strings(manager.aborted)
+            if !reflect.DeepEqual(manager.aborted, tt.want) {
+                t.Errorf("aborted %q, want %q", manager.aborted, tt.want)
+            }
+        })
+    }
+}
+
+func TestCleanupFailures(t *testing.T) {
+    old := storage_clients.MultipartUpload{Key: "backups/app.zip", UploadID: "1", Initiated: time.Now().Add(-48 * time.Hour)}
+    older := storage_clients.MultipartUpload{Key: "backups/db.zip", UploadID: "2", Initiated: time.Now().Add(-72 * time.Hour)}
+    cfg := &CleanupConfig{OlderThan: time.Now().Add(-24 * time.Hour), Abort: true}
+
+    t.Run("failed abort", func(t *testing.T) {
+        manager := &fakeUploadManager{
+            uploads:   []storage_clients.MultipartUpload{old, older},
+            failAbort: map[string]bool{"backups/app.zip": true},
+        }
+        code, err := cleanupUploads(context.Background(), manager, "backups/", cfg, &bytes.Buffer{})
+        if code != ExitCodeUploadFailed || err == nil || !strings.Contains(err.Error(), "1 of 2") {
+            t.Errorf("cleanupUploads() = %d, %v, want %d and 1 of 2 failed", code, err, ExitCodeUploadFailed)
+        }
+        // the other uploads are still aborted
+        if !reflect.DeepEqual(manager.aborted, []string{"backups/db.zip"}) {
+            t.Errorf("aborted %q", manager.aborted)
+        }
+    })
+
+    t.Run("failed listing", func(t *testing.T) {
+        manager := &fakeUploadManager{listErr: errors.New("access denied")}
+        if code, err := cleanupUploads(context.Background(), manager, "backups/", cfg, &bytes.Buffer{}); code != ExitCodeUploadFailed || err == nil {
+            t.Errorf("cleanupUploads() = %d, %v, want %d", code, err, ExitCodeUploadFailed)
+        }
+    })
+}
+
+func TestParseCleanupFlagsRejectsNegativeAge(t *testing.T) {
+    if _, err := ParseCleanupFlags([]string{"-d", "s3://bucket/backups/", "-older-than", "-1h"}); err == nil {
+        t.Error("negative -older-than accepted")
+    }
+}
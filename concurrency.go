@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// concurrencyLimiter bounds the number of parts uploaded at the same time. With
+// auto-tuning, the limit climbs between 1 and the configured maximum: it moves up while
+// more connections bring more throughput, and down when they only make parts slower.
+type concurrencyLimiter struct {
+    mu       sync.Mutex
+    cond     *sync.Cond
+    limit    int
+    max      int
+    inFlight int
+    auto     bool
+
+    // current measurement window, auto-tuning only
+    windowStart   time.Time
+    windowBytes   int64
+    windowParts   int
+    windowLatency time.Duration
+
+    lastThroughput float64 // bytes per second of the previous window
+    lastLatency    time.Duration
+}
+
+func newConcurrencyLimiter(max int, auto bool) *concurrencyLimiter {
+    if max <= 0 {
+        max = DefaultMaxPartsInMemory
+    }
+    l := &concurrencyLimiter{limit: max, max: max, auto: auto}
+    if auto {
+        // start in the middle, so both directions are explored early
+        l.limit = (max + 1) / 2
+    }
+    l.cond = sync.NewCond(&l.mu)
+    return l
+}
+
+// acquire waits for a free upload slot.
+func (l *concurrencyLimiter) acquire() {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for l.inFlight >= l.limit {
+        l.cond.Wait()
+    }
+    if l.auto && l.windowStart.IsZero() {
+        l.windowStart = time.Now()
+    }
+    l.inFlight++
+}
+
+// release frees the slot of a part that took latency to upload bytes.
+func (l *concurrencyLimiter) release(bytes int, latency time.Duration, ok bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.inFlight--
+    if l.auto && ok {
+        l.observe(bytes, latency)
+    }
+    l.cond.Broadcast()
+}
+
+// observe adds a part to the window and tunes the limit once the window is complete,
+// after every slot has been used twice. The caller holds mu.
+func (l *concurrencyLimiter) observe(bytes int, latency time.Duration) {
+    l.windowBytes += int64(bytes)
+    l.windowParts++
+    l.windowLatency += latency
+    if l.windowParts < 2*l.limit {
+        return
+    }
+
+    elapsed := time.Since(l.windowStart).Seconds()
+    if elapsed <= 0 {
+        return
+    }
+    throughput := float64(l.windowBytes) / elapsed
+    latencyMean := l.windowLatency / time.Duration(l.windowParts)
+
+    previous := l.limit
+    switch {
+    case l.lastThroughput == 0 || throughput >= l.lastThroughput*1.05:
+        // first window, or more connections paid off: try one more
+        if l.limit < l.max {
+            l.limit++
+        }
+    case latencyMean >= l.lastLatency*6/5:
+        // no gain and parts got slower: the connections compete with each other
+        if l.limit > 1 {
+            l.limit--
+        }
+    }
+    if l.limit != previous {
+        slog.Debug("Upload concurrency tuned", "concurrency", l.limit, "previous", previous,
+            "throughput_bytes_per_second", int64(throughput), "part_latency", latencyMean)
+    }
+
+    l.lastThroughput = throughput
+    l.lastLatency = latencyMean
+    l.windowStart = time.Now()
+    l.windowBytes, l.windowParts, l.windowLatency = 0, 0, 0
+}
+
+// current returns the current limit.
+func (l *concurrencyLimiter) current() int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.limit
+}
@@ -5,20 +5,52 @@ import (
 	"flag"
 	"fmt"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"t-sync/storage_clients"
+	"t-sync/tracing"
 )
 
 // this holds all the command line config you can pass to t-sync
 type Config struct {
-    Source           string
-    Destination      *url.URL
+    Sources          []ArchiveSource
+    Destinations     []*url.URL // the archive is written to all of them
+    DestFailure      string     // DestFailureFail or DestFailureContinue
     CompressionLevel int
     AuthType         string
     MaxPartsInMemory int
+    PartConcurrency  int // parts uploaded in parallel, at most MaxPartsInMemory
+    AutoConcurrency  bool
+    SpoolDir         string // spool parts to temporary files in this directory instead of memory
+    Raw              bool   // upload the single source as is, without zipping it
     MinPartSize      int // in bytes
     Password         string
     IgnoreFile       string
+    Filters          FilterOptions
+    Rewriter         *PathRewriter
+    ShardBy          string // "", "dir" or "size"
+    ShardSize        int64  // target uncompressed bytes per shard when sharding by size
+    ShardParallelism int
+    UploadLimit      *BandwidthLimiter // shared by all upload workers, nil for unlimited
+    ReadLimit        *BandwidthLimiter // shared by all archivers, nil for unlimited
+    DryRun           bool
+    Progress         string
+    ProgressInterval time.Duration
+    LogFormat        string
+    LogLevel         string
+    Quiet            bool
+    ReportFile       string
+    ReportUpload     bool
+    MetricsAddr      string
+    PushgatewayURL   string
+    PushgatewayJob   string
+    OTLPEndpoint     string
+    OTLPHeaders      map[string]string
+    ServiceName      string
+    RetryPolicy      storage_clients.RetryPolicy
 }
 
 // DestDetails holds parsed details from the destination URL.
@@ -29,6 +61,24 @@ type DestDetails struct {
     Key       string
 }
 
+// String returns the destination as a URI, for logs and the run report.
+func (d *DestDetails) String() string {
+    switch d.Provider {
+    case "stdout":
+        return StdoutDestination
+    case "oci":
+        return fmt.Sprintf("oci://%s@%s/%s", d.Namespace, d.Bucket, d.Key)
+    case "file":
+        return "file:///" + d.Key
+    }
+    return fmt.Sprintf("%s://%s/%s", d.Provider, d.Bucket, d.Key)
+}
+
+// IsLocal reports whether the destination is a local file or stdout rather than object storage.
+func (d *DestDetails) IsLocal() bool {
+    return d.Provider == "file" || d.Provider == "stdout"
+}
+
 var compressionLevelByExtension = map[string]int{
     ".zip":  0,
     ".gz":   0,
@@ -51,6 +101,11 @@ const (
     DefaultCompressionLevel = 6
     DefaultMinPartSizeInMiB = 10
     DefaultMaxPartsInMemory = 10
+    DefaultShardSizeInMiB   = 1024
+    DefaultShardParallelism = 4
+
+    // StdoutDestination writes the archive to stdout, for pipelines. file:///dev/stdout is the same.
+    StdoutDestination = "-"
 )
 
 func getCompressionLevelForFile(filename string, defaultLevel int) int {
@@ -73,6 +128,7 @@ const (
     ExitCodeInvalidParameters    = 40 // Bad Parameters
     ExitCodeAuthenticationFailed = 41 // Authentication Failed
     ExitCodeSourceDirNotFound    = 44 // Source directory not found
+    ExitCodeInterrupted          = 49 // Interrupted by SIGINT or SIGTERM, upload aborted
     ExitCodeInternalCodeError    = 50 // Internal Code Error
     ExitCodeUploadFailed         = 52 // Upload Failed
     ExitCodeUploaderClientFailed = 53 // Client Failed
@@ -102,6 +158,9 @@ func isValidAuthType(authType string) bool {
 }
 
 func ParseDestURL(dest *url.URL) (*DestDetails, error) {
+    if isStdoutDest(dest) {
+        return &DestDetails{Provider: "stdout", Key: StdoutDestination}, nil
+    }
     details := &DestDetails{
         Provider: dest.Scheme,
         Key:      strings.TrimLeft(dest.Path, "/"),
@@ -126,13 +185,111 @@ func ParseDestURL(dest *url.URL) (*DestDetails, error) {
     return details, nil
 }
 
+// isStdoutDest reports whether dest is "-" or file:///dev/stdout.
+func isStdoutDest(dest *url.URL) bool {
+    return (dest.Scheme == "" && dest.Path == StdoutDestination) || (dest.Scheme == "file" && dest.Path == "/dev/stdout")
+}
+
+// stringListFlag collects the values of a flag that may be repeated.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+    return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+    *f = append(*f, value)
+    return nil
+}
+
+// ArchiveOptions returns the options passed to the archiver.
+func (cfg *Config) ArchiveOptions() ArchiveOptions {
+    return ArchiveOptions{
+        CompressionLevel: cfg.CompressionLevel,
+        Password:         cfg.Password,
+        IgnoreFile:       cfg.IgnoreFile,
+        Filters:          cfg.Filters,
+        Rewriter:         cfg.Rewriter,
+        ReadLimit:        cfg.ReadLimit,
+    }
+}
+
+// UploadOptions returns the options passed to the uploader.
+func (cfg *Config) UploadOptions() UploadOptions {
+    return UploadOptions{
+        Concurrency: cfg.PartConcurrency,
+        AutoTune:    cfg.AutoConcurrency,
+        Limiter:     cfg.UploadLimit,
+    }
+}
+
+// validateRawSource checks that a raw upload has a single source that isn't a directory,
+// and none of the options that only apply to archives.
+func validateRawSource(cfg *Config, sources []ArchiveSource) error {
+    if len(sources) != 1 {
+        return fmt.Errorf("-raw takes exactly one source")
+    }
+    f := cfg.Filters
+    selects := len(f.Includes) > 0 || len(f.Excludes) > 0 || f.MinSize > 0 || f.MaxSize > 0 ||
+        !f.NewerThan.IsZero() || !f.OlderThan.IsZero() || f.Explain || cfg.IgnoreFile != "" || len(f.NestedIgnoreFiles) > 0
+    if cfg.ShardBy != "" || cfg.Password != "" || cfg.Rewriter != nil || cfg.DryRun || selects {
+        return fmt.Errorf("-raw can't be combined with -shard-by, -password, -prefix, -transform, -dry-run " +
+            "or the file selection options (-include, -exclude, -min-file-size, -max-file-size, -newer-than, " +
+            "-older-than, -ignore-file, -nested-ignore, -gitignore, -explain)")
+    }
+    if path := sources[0].Path; path != StdinSource {
+        if info, err := os.Stat(path); err == nil && info.IsDir() {
+            return fmt.Errorf("-raw needs a file, a named pipe or '-', %s is a directory", path)
+        }
+    }
+    return nil
+}
+
+// addRetryFlags defines the flags of the retry policy used for every storage call.
+func addRetryFlags(flags *flag.FlagSet, policy *storage_clients.RetryPolicy) {
+    defaults := storage_clients.DefaultRetryPolicy
+    flags.IntVar(&policy.MaxAttempts, "retry-max-attempts", defaults.MaxAttempts, "Maximum attempts of each storage call. Auth, not found and other client errors are never retried.")
+    flags.DurationVar(&policy.BaseDelay, "retry-base-delay", defaults.BaseDelay, "Base delay between retries, doubled on every attempt, with full jitter.")
+    flags.DurationVar(&policy.MaxDelay, "retry-max-delay", defaults.MaxDelay, "Maximum delay between retries.")
+    flags.DurationVar(&policy.Deadline, "retry-deadline", defaults.Deadline, "Stop retrying a storage call once this much time has passed since its first attempt (0 for no limit).")
+}
+
+func validateRetryPolicy(policy storage_clients.RetryPolicy) error {
+    if policy.MaxAttempts < 1 {
+        return fmt.Errorf("retry-max-attempts must be at least 1")
+    }
+    if policy.BaseDelay < 0 || policy.MaxDelay < 0 || policy.Deadline < 0 {
+        return fmt.Errorf("retry delays and deadline must not be negative")
+    }
+    if policy.MaxDelay < policy.BaseDelay {
+        return fmt.Errorf("retry-max-delay must not be less than retry-base-delay")
+    }
+    return nil
+}
+
+// serviceNameFromEnv returns the service name of the exported traces, $OTEL_SERVICE_NAME or t-sync.
+func serviceNameFromEnv() string {
+    if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+        return name
+    }
+    return "t-sync"
+}
+
 func ParseFlags() (*Config, error) {
     cfg := &Config{}
-    var destStr string
+    var destArgs stringListFlag
+    var sourceArgs sourceListFlag
+    var filesFrom string
 
     // source and destination configuration
-    flag.StringVar(&cfg.Source, "s", "", "Source directory to zip.")
-    flag.StringVar(&destStr, "d", "", "Destination URI (e.g., file:///path/to/file.zip, oci://namespace@bucket/key, s3://bucket/key).")
+    var entryName string
+    flag.Var(&sourceArgs, "s", "Source directory or file to zip. Can be repeated. Use '-' to stream stdin into a single entry.")
+    flag.Var(sourcePrefixFlag{&sourceArgs}, "source-prefix", "Archive path to store the preceding -s under instead of its default path.")
+    flag.StringVar(&entryName, "entry-name", DefaultStdinEntryName, "Archive path of the entry read from stdin with '-s -'.")
+    flag.StringVar(&filesFrom, "files-from", "", "Read additional source paths from this file, one per line or NUL separated ('-' for stdin).")
+    flag.BoolVar(&cfg.Raw, "raw", false, "Upload a single file, named pipe or stdin ('-s -') as is, without zipping it. Same as the 'put' command.")
+    flag.Var(&destArgs, "d", "Destination URI (e.g., file:///path/to/file.zip, oci://namespace@bucket/key, s3://bucket/key), or '-' for stdout. Can be repeated to write the same archive to several destinations.")
+    flag.StringVar(&cfg.DestFailure, "destination-failure", DestFailureFail, "With several -d, what a failed destination does: 'fail' aborts the others and fails the run, 'continue' carries on with the rest and only fails the run when all of them failed.")
 
     // compression level: default selected is 6 for best speed vs compression ratio tradeoff.
     flag.IntVar(&cfg.CompressionLevel, "compression-level", DefaultCompressionLevel, "Compression level (0-9).")
@@ -141,7 +298,10 @@ func ParseFlags() (*Config, error) {
     flag.StringVar(&cfg.AuthType, "auth-type", "", "Authentication type (e.g., OCI_CONFIG_FILE, OKE_WORKLOAD_IDENTITY, INSTANCE_PRINCIPAL, S3_ACCESS_KEYS[ACCESS_KEY:SECRET_KEY] or S3_ACCESS_KEYS[ACCESS_KEY:SECRET_KEY:SESSION_TOKEN]).")
 
     // multipart upload config
-    flag.IntVar(&cfg.MaxPartsInMemory, "max-parts-in-memory", DefaultMaxPartsInMemory, "Maximum number of parts to hold in memory before applying backpressure.")
+    flag.IntVar(&cfg.MaxPartsInMemory, "max-parts-in-memory", DefaultMaxPartsInMemory, "Maximum number of parts to hold in memory per upload before applying backpressure. Every destination, and every shard uploaded in parallel, has its own parts, so memory is capped at this many parts of -min-part-size-mb × destinations × -shard-parallelism.")
+    flag.IntVar(&cfg.PartConcurrency, "upload-concurrency", 0, "Number of parts uploaded in parallel, at most -max-parts-in-memory. Defaults to -max-parts-in-memory.")
+    flag.BoolVar(&cfg.AutoConcurrency, "auto-concurrency", false, "Tune the number of parallel part uploads between 1 and -upload-concurrency to the observed throughput and part latency.")
+    flag.StringVar(&cfg.SpoolDir, "spool-dir", "", "Write parts to temporary files in this directory instead of holding them in memory. -max-parts-in-memory then limits the parts on disk.")
     flag.IntVar(&cfg.MinPartSize, "min-part-size-mb", DefaultMinPartSizeInMiB, "Minimum part size in MB for multipart uploads.")
 
     // password when zip encryption is enabled
@@ -150,9 +310,69 @@ func ParseFlags() (*Config, error) {
     // ignore file
     flag.StringVar(&cfg.IgnoreFile, "ignore-file", "", "Path to a file with .gitignore style patterns to ignore. File can be named '.tsyncignore'.")
 
+    // selection filters on top of the ignore file
+    var includeArgs, excludeArgs stringListFlag
+    var minFileSize, maxFileSize, newerThan, olderThan string
+    flag.Var(&includeArgs, "include", "Only archive files matching this .gitignore style pattern. Can be repeated.")
+    flag.Var(&excludeArgs, "exclude", "Exclude paths matching this .gitignore style pattern, in addition to the ignore file. Can be repeated.")
+    flag.StringVar(&minFileSize, "min-file-size", "", "Skip files smaller than this size (e.g. 1KiB).")
+    flag.StringVar(&maxFileSize, "max-file-size", "", "Skip files larger than this size (e.g. 2GiB).")
+    flag.StringVar(&newerThan, "newer-than", "", "Only archive files modified after this time: an age like 24h or 7d, or a timestamp like 2026-10-17.")
+    flag.StringVar(&olderThan, "older-than", "", "Only archive files modified before this time: an age like 24h or 7d, or a timestamp like 2026-10-17.")
+    var nestedIgnore, useGitignore bool
+    flag.BoolVar(&nestedIgnore, "nested-ignore", false, "Honor a "+TsyncIgnoreFileName+" file in every directory, scoped to that directory like .gitignore.")
+    flag.BoolVar(&useGitignore, "gitignore", false, "Also honor "+GitIgnoreFileName+" files in every directory. "+TsyncIgnoreFileName+" wins over "+GitIgnoreFileName+" in the same directory.")
+    flag.BoolVar(&cfg.Filters.Explain, "explain", false, "Log which rule excluded each path.")
+
+    // archive path rewriting
+    var prefix string
+    var transformArgs stringListFlag
+    flag.StringVar(&prefix, "prefix", "", "Prefix prepended to every path in the archive (e.g. backup-2026-10-17/).")
+    flag.Var(&transformArgs, "transform", "sed-like rule applied to every path in the archive before the prefix, e.g. 's|^var/lib/|data/|'. Can be repeated, rules apply in order.")
+
+    // bandwidth limits
+    var bwLimit, readLimit string
+    flag.StringVar(&bwLimit, "bwlimit", "", "Limit the upload bandwidth, e.g. '50MiB/s', or a timetable like '08:00,10MiB/s 18:00,off'.")
+    flag.StringVar(&readLimit, "read-limit", "", "Limit the rate at which source files are read from disk, same format as -bwlimit.")
+
+    // sharding: split the archive into several independent zips
+    var shardSizeMiB int64
+    flag.StringVar(&cfg.ShardBy, "shard-by", "", "Split the archive into shards, one object per shard: 'dir' (one per top-level directory) or 'size' (buckets of -shard-size-mb).")
+    flag.Int64Var(&shardSizeMiB, "shard-size-mb", DefaultShardSizeInMiB, "Target uncompressed size in MB of each shard when -shard-by=size.")
+    flag.IntVar(&cfg.ShardParallelism, "shard-parallelism", DefaultShardParallelism, "Number of shards archived and uploaded in parallel.")
+
+    flag.BoolVar(&cfg.DryRun, "dry-run", false, "Walk and filter the sources, print a JSON line per path and a summary with the estimated size and parts, and check credentials, without writing or uploading anything.")
+
+    // progress reporting
+    flag.StringVar(&cfg.Progress, "progress", ProgressOff, "Progress reporting on stderr: off, auto, bar or json. auto uses a bar on a terminal and JSON lines otherwise.")
+    flag.DurationVar(&cfg.ProgressInterval, "progress-interval", time.Second, "How often progress is reported.")
+
+    // logging
+    flag.StringVar(&cfg.LogFormat, "log-format", LogFormatText, "Log format on stderr: text or json.")
+    flag.StringVar(&cfg.LogLevel, "log-level", "info", "Log level: debug, info, warn or error. Per-file and per-part messages are logged at debug.")
+    flag.BoolVar(&cfg.Quiet, "quiet", false, "Only log errors.")
+
+    // run report
+    flag.StringVar(&cfg.ReportFile, "report-file", "", "Write a JSON summary of the run to this file at exit ('-' for stdout).")
+    flag.BoolVar(&cfg.ReportUpload, "report-upload", false, "Also write the JSON summary next to the archive, as <key>.report.json.")
+
+    // metrics
+    flag.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address (e.g. ':9090') at /metrics while the run is in progress.")
+    flag.StringVar(&cfg.PushgatewayURL, "pushgateway-url", "", "Push the final metrics of the run to this Prometheus Pushgateway at exit.")
+    flag.StringVar(&cfg.PushgatewayJob, "pushgateway-job", "t-sync", "Job name used when pushing to the Pushgateway.")
+
+    // retries
+    addRetryFlags(flag.CommandLine, &cfg.RetryPolicy)
+
+    // tracing
+    var otlpHeaders string
+    flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", tracing.EndpointFromEnv(), "Export OpenTelemetry traces to this OTLP/HTTP endpoint (e.g. http://localhost:4318). Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT.")
+    flag.StringVar(&otlpHeaders, "otlp-headers", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), "Headers sent to the OTLP endpoint, as key=value pairs separated by commas. Defaults to $OTEL_EXPORTER_OTLP_HEADERS.")
+    flag.StringVar(&cfg.ServiceName, "service-name", serviceNameFromEnv(), "Service name of the exported traces. Defaults to $OTEL_SERVICE_NAME or t-sync.")
+
     flag.Parse()
 
-    if cfg.Source == "" || destStr == "" {
+    if (len(sourceArgs) == 0 && filesFrom == "") || len(destArgs) == 0 {
         flag.Usage()
         return nil, errors.New("source and destination are required")
     }
@@ -162,31 +382,207 @@ func ParseFlags() (*Config, error) {
         return nil, fmt.Errorf("max-parts-in-memory must be greater than 0")
     }
 
+    if cfg.PartConcurrency < 0 {
+        flag.Usage()
+        return nil, fmt.Errorf("upload-concurrency must not be negative")
+    }
+    if cfg.PartConcurrency == 0 {
+        cfg.PartConcurrency = cfg.MaxPartsInMemory
+    }
+    if cfg.PartConcurrency > cfg.MaxPartsInMemory {
+        // every part being uploaded holds one of the buffers, more workers would only wait for data
+        flag.Usage()
+        return nil, fmt.Errorf("upload-concurrency %d is above max-parts-in-memory %d, raise max-parts-in-memory and lower min-part-size-mb to upload more parts in parallel with the same memory", cfg.PartConcurrency, cfg.MaxPartsInMemory)
+    }
+
     if cfg.MinPartSize < 5 {
         flag.Usage()
         return nil, fmt.Errorf("min-part-size-mb must be greater than 5")
     }
 
-    destURL, err := url.Parse(destStr)
+    if cfg.SpoolDir != "" {
+        if info, err := os.Stat(cfg.SpoolDir); err != nil || !info.IsDir() {
+            flag.Usage()
+            return nil, fmt.Errorf("spool-dir %s is not a directory", cfg.SpoolDir)
+        }
+    }
+
+    switch cfg.ShardBy {
+    case "", ShardByDir:
+    case ShardBySize:
+        if shardSizeMiB <= 0 {
+            flag.Usage()
+            return nil, fmt.Errorf("shard-size-mb must be greater than 0")
+        }
+    default:
+        flag.Usage()
+        return nil, fmt.Errorf("unsupported shard-by: %s, expected 'dir' or 'size'", cfg.ShardBy)
+    }
+
+    switch cfg.Progress {
+    case ProgressOff, ProgressAuto, ProgressBar, ProgressJSON:
+    default:
+        flag.Usage()
+        return nil, fmt.Errorf("unsupported progress: %s, expected off, auto, bar or json", cfg.Progress)
+    }
+    if cfg.ProgressInterval <= 0 {
+        flag.Usage()
+        return nil, fmt.Errorf("progress-interval must be greater than 0")
+    }
+
+    if cfg.ShardParallelism <= 0 {
+        flag.Usage()
+        return nil, fmt.Errorf("shard-parallelism must be greater than 0")
+    }
+
+    if err := validateRetryPolicy(cfg.RetryPolicy); err != nil {
+        flag.Usage()
+        return nil, err
+    }
+
+    if cfg.PushgatewayURL != "" && !strings.HasPrefix(cfg.PushgatewayURL, "http://") && !strings.HasPrefix(cfg.PushgatewayURL, "https://") {
+        flag.Usage()
+        return nil, fmt.Errorf("pushgateway-url must start with http:// or https://")
+    }
+
+    entryName = strings.Trim(entryName, "/")
+    if entryName == "" {
+        flag.Usage()
+        return nil, fmt.Errorf("entry-name must not be empty")
+    }
+    sources, err := ResolveSources(sourceArgs, filesFrom, entryName)
     if err != nil {
-        return nil, fmt.Errorf("invalid destination URI: %v", err)
+        return nil, err
+    }
+    for _, src := range sources {
+        if src.Path == StdinSource && cfg.ShardBy != "" {
+            flag.Usage()
+            return nil, fmt.Errorf("stdin can't be archived with -shard-by")
+        }
     }
 
-    switch destURL.Scheme {
-    case "oci":
-        if ok := isValidAuthType(cfg.AuthType); !ok {
+    if cfg.OTLPHeaders, err = tracing.ParseHeaders(otlpHeaders); err != nil {
+        flag.Usage()
+        return nil, fmt.Errorf("invalid otlp-headers: %v", err)
+    }
+
+    // later names take precedence within a directory
+    if useGitignore {
+        cfg.Filters.NestedIgnoreFiles = append(cfg.Filters.NestedIgnoreFiles, GitIgnoreFileName)
+    }
+    if nestedIgnore {
+        cfg.Filters.NestedIgnoreFiles = append(cfg.Filters.NestedIgnoreFiles, TsyncIgnoreFileName)
+    }
+    cfg.Filters.Includes = includeArgs
+    cfg.Filters.Excludes = excludeArgs
+    if minFileSize != "" {
+        if cfg.Filters.MinSize, err = parseByteSize(minFileSize); err != nil {
+            return nil, fmt.Errorf("invalid min-file-size: %v", err)
+        }
+    }
+    if maxFileSize != "" {
+        if cfg.Filters.MaxSize, err = parseByteSize(maxFileSize); err != nil {
+            return nil, fmt.Errorf("invalid max-file-size: %v", err)
+        }
+    }
+    now := time.Now()
+    if newerThan != "" {
+        if cfg.Filters.NewerThan, err = parseTimeOrAge(newerThan, now); err != nil {
+            return nil, fmt.Errorf("invalid newer-than: %v", err)
+        }
+    }
+    if olderThan != "" {
+        if cfg.Filters.OlderThan, err = parseTimeOrAge(olderThan, now); err != nil {
+            return nil, fmt.Errorf("invalid older-than: %v", err)
+        }
+    }
+
+    if prefix != "" || len(transformArgs) > 0 {
+        archivePrefix, err := ParseArchivePrefix(prefix)
+        if err != nil {
             flag.Usage()
-            return nil, fmt.Errorf("unsupported auth-type for oci: %s", cfg.AuthType)
+            return nil, err
         }
-    case "s3":
-        if !strings.HasPrefix(cfg.AuthType, "S3_ACCESS_KEYS[") || !strings.HasSuffix(cfg.AuthType, "]") || !strings.Contains(cfg.AuthType, ":") {
+        cfg.Rewriter = &PathRewriter{Prefix: archivePrefix}
+        for _, expr := range transformArgs {
+            t, err := ParsePathTransform(expr)
+            if err != nil {
+                flag.Usage()
+                return nil, err
+            }
+            cfg.Rewriter.Transforms = append(cfg.Rewriter.Transforms, t)
+        }
+    }
+
+    if cfg.UploadLimit, err = ParseBandwidthLimit(bwLimit); err != nil {
+        flag.Usage()
+        return nil, fmt.Errorf("invalid bwlimit: %v", err)
+    }
+    if cfg.ReadLimit, err = ParseBandwidthLimit(readLimit); err != nil {
+        flag.Usage()
+        return nil, fmt.Errorf("invalid read-limit: %v", err)
+    }
+
+    if cfg.Raw {
+        if err := validateRawSource(cfg, sources); err != nil {
+            flag.Usage()
+            return nil, err
+        }
+    }
+
+    seen := make(map[string]bool)
+    for _, destStr := range destArgs {
+        destURL, err := url.Parse(destStr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid destination URI: %v", err)
+        }
+        if isStdoutDest(destURL) {
+            // both spellings are the same destination
+            destURL = &url.URL{Path: StdoutDestination}
+            if cfg.ShardBy != "" {
+                flag.Usage()
+                return nil, fmt.Errorf("-shard-by writes several archives, it can't write to stdout")
+            }
+            if cfg.ReportFile == "-" {
+                flag.Usage()
+                return nil, fmt.Errorf("-report-file - would mix the report into the archive on stdout")
+            }
+        }
+        if seen[destURL.String()] {
             flag.Usage()
-            return nil, fmt.Errorf("unsupported auth-type for s3: %s, expected S3_ACCESS_KEYS[ACCESS_KEY:SECRET_KEY] or S3_ACCESS_KEYS[ACCESS_KEY:SECRET_KEY:SESSION_TOKEN]", cfg.AuthType)
+            return nil, fmt.Errorf("destination %s is given more than once", destURL)
         }
+        seen[destURL.String()] = true
+
+        switch destURL.Scheme {
+        case "oci":
+            if ok := isValidAuthType(cfg.AuthType); !ok {
+                flag.Usage()
+                return nil, fmt.Errorf("unsupported auth-type for oci: %s", cfg.AuthType)
+            }
+        case "s3":
+            if !strings.HasPrefix(cfg.AuthType, "S3_ACCESS_KEYS[") || !strings.HasSuffix(cfg.AuthType, "]") || !strings.Contains(cfg.AuthType, ":") {
+                flag.Usage()
+                return nil, fmt.Errorf("unsupported auth-type for s3: %s, expected S3_ACCESS_KEYS[ACCESS_KEY:SECRET_KEY] or S3_ACCESS_KEYS[ACCESS_KEY:SECRET_KEY:SESSION_TOKEN]", cfg.AuthType)
+            }
+        }
+        cfg.Destinations = append(cfg.Destinations, destURL)
+    }
+
+    switch cfg.DestFailure {
+    case DestFailureFail, DestFailureContinue:
+    default:
+        flag.Usage()
+        return nil, fmt.Errorf("unsupported destination-failure: %s, expected fail or continue", cfg.DestFailure)
+    }
+    if len(cfg.Destinations) > 1 && cfg.ShardBy != "" {
+        flag.Usage()
+        return nil, fmt.Errorf("-shard-by writes to a single destination, it can't be combined with several -d")
     }
 
-    cfg.Destination = destURL
+    cfg.Sources = sources
     cfg.MinPartSize = cfg.MinPartSize * KiB * KiB // Convert to bytes
+    cfg.ShardSize = shardSizeMiB * KiB * KiB       // Convert to bytes
 
     return cfg, nil
 }
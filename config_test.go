@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRawSource(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "dump.sql")
+    writeTree(t, dir, map[string]string{"dump.sql": "select 1;"})
+
+    tests := []struct {
+        name    string
+        cfg     Config
+        sources []ArchiveSource
+        wantErr string
+    }{
+        {"file", Config{}, []ArchiveSource{{Path: file}}, ""},
+        {"stdin", Config{}, []ArchiveSource{{Path: StdinSource}}, ""},
+        {"two sources", Config{}, []ArchiveSource{{Path: file}, {Path: file}}, "exactly one source"},
+        {"directory", Config{}, []ArchiveSource{{Path: dir}}, "is a directory"},
+        {"shard-by", Config{ShardBy: "dir"}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"password", Config{Password: "secret"}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"prefix", Config{Rewriter: &PathRewriter{Prefix: "x"}}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"dry-run", Config{DryRun: true}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"include", Config{Filters: FilterOptions{Includes: []string{"*.sql"}}}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"exclude", Config{Filters: FilterOptions{Excludes: []string{"*.log"}}}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"min-file-size", Config{Filters: FilterOptions{MinSize: 1}}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"max-file-size", Config{Filters: FilterOptions{MaxSize: 1}}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"newer-than", Config{Filters: FilterOptions{NewerThan: time.Now()}}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"older-than", Config{Filters: FilterOptions{OlderThan: time.Now()}}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"ignore-file", Config{IgnoreFile: ".tsyncignore"}, []ArchiveSource{{Path: file}}, "can't be combined"},
+        {"gitignore", Config{Filters: FilterOptions{NestedIgnoreFiles: []string{GitIgnoreFileName}}}, []ArchiveSource{{Path: file}}, "can't be combined"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := validateRawSource(&tt.cfg, tt.sources)
+            if tt.wantErr == "" {
+                if err != nil {
+                    t.Fatalf("err = %v", err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Fatalf("err = %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
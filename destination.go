@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"t-sync/storage_clients"
+)
+
+// Destination is the write side of a single archive stream: either a local file, stdout
+// or a multipart upload fed through a channelWriter.
+type Destination struct {
+    writer    io.Writer
+    file      *partialFile // set for local files
+    uploadWg  sync.WaitGroup
+    uploadErr error
+
+    // set for uploads: cancel stops the upload goroutine, done is closed once it returned
+    channelWriter *channelWriter
+    cancel        context.CancelCauseFunc
+    done          chan struct{}
+
+    name    string // URI, for logs and the run report
+    key     string
+    written int64
+    result  ObjectResult
+    stats   *RunStats
+}
+
+// OpenDestination prepares the writer for the given destination. For object storage
+// it also starts the upload goroutine, which is waited on by Wait.
+func OpenDestination(ctx context.Context, details *DestDetails, cfg *Config, stats *RunStats) (*Destination, error) {
+    d := &Destination{name: details.String(), key: details.Key, stats: stats}
+
+    if details.Provider == "stdout" {
+        // stdout is neither closed nor removed on abort, the reader sees the exit code
+        slog.Info("Writing archive to stdout")
+        d.writer = os.Stdout
+        return d, nil
+    }
+
+    if details.Provider == "file" {
+        absOutFile, err := filepath.Abs(details.Key)
+        slog.Info("Output file", "file", absOutFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to resolve absolute path for output file: %v", err)
+        }
+        if mkdirErr := os.MkdirAll(filepath.Dir(absOutFile), os.ModePerm); mkdirErr != nil {
+            return nil, fmt.Errorf("failed to create output directory: %v", mkdirErr)
+        }
+        outFile, err := createPartialFile(absOutFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to create zip file: %v", err)
+        }
+        d.key = absOutFile
+        d.name = "file://" + absOutFile
+        d.file = outFile
+        d.writer = outFile
+        return d, nil
+    }
+
+    uploader, err := NewUploader(details, cfg.AuthType)
+    if err != nil {
+        return nil, &uploaderClientError{err}
+    }
+
+    var spool *partSpool
+    if cfg.SpoolDir != "" {
+        if spool, err = newPartSpool(cfg.SpoolDir, cfg.MaxPartsInMemory); err != nil {
+            return nil, err
+        }
+    }
+
+    uploadCtx, cancel := context.WithCancelCause(ctx)
+    d.cancel = cancel
+    d.done = make(chan struct{})
+
+    partChan := make(chan Part, cfg.MaxPartsInMemory)
+    stats.TrackPartBacklog(func() int { return len(partChan) })
+    d.channelWriter = NewChannelWriter(partChan, d.done, cfg.MinPartSize, cfg.MaxPartsInMemory, spool)
+    d.writer = d.channelWriter
+
+    d.uploadWg.Add(1)
+    go func() {
+        d.result, d.uploadErr = uploadToObjectStorage(uploadCtx, uploader, partChan, &d.uploadWg, cfg.UploadOptions(), stats)
+        close(d.done)
+    }()
+
+    return d, nil
+}
+
+// errDestinationFailed marks the failures of the destination itself, e.g. a full disk or
+// a closed stdout, so they aren't mistaken for failures to read or compress the sources.
+var errDestinationFailed = errors.New("destination failed")
+
+// Write implements io.Writer.
+func (d *Destination) Write(p []byte) (int, error) {
+    n, err := d.writer.Write(p)
+    d.written += int64(n)
+    switch {
+    case err == errUploadStopped:
+        // done is closed, so the upload error can be read
+        err = fmt.Errorf("%w: %v", errUploadStopped, d.uploadErr)
+    case err != nil:
+        err = fmt.Errorf("%w: %s: %v", errDestinationFailed, d.name, err)
+    }
+    return n, err
+}
+
+// Close flushes and closes the underlying writer. A local file is synced and renamed to
+// its final name, for uploads this closes the part channel.
+func (d *Destination) Close() error {
+    switch {
+    case d.file != nil:
+        if err := d.file.commit(); err != nil {
+            return fmt.Errorf("%w: %s: %v", errDestinationFailed, d.name, err)
+        }
+        return nil
+    case d.channelWriter == nil:
+        return nil
+    }
+    err := d.channelWriter.Close()
+    if err == errUploadStopped {
+        err = fmt.Errorf("%w: %v", errUploadStopped, d.uploadErr)
+    }
+    return err
+}
+
+// Abort stops writing the archive because of cause. An upload is cancelled and its
+// multipart upload aborted instead of completed, a local file is removed. Wait returns
+// the resulting error.
+func (d *Destination) Abort(cause error) {
+    if d.channelWriter == nil {
+        if d.file != nil {
+            d.file.discard()
+        }
+        if d.uploadErr == nil {
+            d.uploadErr = cause
+        }
+        return
+    }
+    d.cancel(cause)
+    d.channelWriter.abort()
+}
+
+// Wait blocks until the upload (if any) has finished and returns its error.
+// A successfully written object is recorded in the run stats.
+func (d *Destination) Wait() error {
+    d.uploadWg.Wait()
+    if d.cancel != nil {
+        <-d.done
+        d.cancel(nil)
+        d.channelWriter.removeSpool()
+    }
+    if d.uploadErr == nil {
+        result := d.result
+        result.Key = d.key
+        result.Destination = d.name
+        if result.Bytes == 0 {
+            result.Bytes = d.written
+        }
+        d.stats.RecordObject(result)
+    }
+    return d.uploadErr
+}
+
+// archiveDestination is what an archive is written to, a Destination or a TeeDestination.
+type archiveDestination interface {
+    io.WriteCloser
+    Abort(cause error)
+    Wait() error
+}
+
+// finishDestination completes dest once the archive has been written, or aborts it when
+// archiveErr is set, and maps the outcome of the run to an exit code.
+func finishDestination(ctx context.Context, dest archiveDestination, archiveErr error) (int, error) {
+    var closeErr error
+    if archiveErr != nil {
+        dest.Abort(archiveErr)
+    } else if closeErr = dest.Close(); closeErr != nil {
+        dest.Abort(closeErr)
+    }
+    uploadErr := dest.Wait()
+
+    if err := interrupted(ctx); err != nil {
+        return ExitCodeInterrupted, fmt.Errorf("%v, upload aborted", err)
+    }
+    // the archive stopped because the upload failed first
+    if errors.Is(archiveErr, errUploadStopped) || errors.Is(closeErr, errUploadStopped) {
+        return uploadFailedCode(uploadErr), fmt.Errorf("upload failed: %v", uploadErr)
+    }
+    // the archive was fine, writing it out failed
+    if errors.Is(archiveErr, errDestinationFailed) {
+        return ExitCodeUploadFailed, fmt.Errorf("failed to write archive: %v", archiveErr)
+    }
+    if errors.Is(closeErr, errDestinationFailed) {
+        return ExitCodeUploadFailed, fmt.Errorf("failed to write archive: %v", closeErr)
+    }
+    if archiveErr != nil {
+        return ExitCodeZipArchiverFailed, fmt.Errorf("failed to create zip archive: %v", archiveErr)
+    }
+    if closeErr != nil {
+        return ExitCodeInternalCodeError, fmt.Errorf("failed to close writer: %v", closeErr)
+    }
+    if uploadErr != nil {
+        return uploadFailedCode(uploadErr), fmt.Errorf("upload failed: %v", uploadErr)
+    }
+    return 0, nil
+}
+
+// uploadFailedCode returns the exit code of a failed upload: rejected credentials get
+// their own code, as retrying the run won't help.
+func uploadFailedCode(err error) int {
+    var retryErr *storage_clients.RetryError
+    if errors.As(err, &retryErr) && retryErr.Class == storage_clients.ErrorClassAuth {
+        return ExitCodeAuthenticationFailed
+    }
+    return ExitCodeUploadFailed
+}
+
+// uploaderClientError marks a failure to create the storage client, so main can map it to its own exit code.
+type uploaderClientError struct {
+    err error
+}
+
+func (e *uploaderClientError) Error() string {
+    return e.err.Error()
+}
+
+func (e *uploaderClientError) Unwrap() error {
+    return e.err
+}
+
+// writeSmallObject writes a small in-memory payload (e.g. a shard index) to a destination.
+func writeSmallObject(ctx context.Context, details *DestDetails, authType string, data []byte) error {
+    if details.Provider == "file" {
+        absOutFile, err := filepath.Abs(details.Key)
+        if err != nil {
+            return fmt.Errorf("failed to resolve absolute path for %s: %v", details.Key, err)
+        }
+        if err := os.MkdirAll(filepath.Dir(absOutFile), os.ModePerm); err != nil {
+            return fmt.Errorf("failed to create output directory: %v", err)
+        }
+        return writeFileAtomic(absOutFile, data)
+    }
+
+    uploader, err := NewUploader(details, authType)
+    if err != nil {
+        return &uploaderClientError{err}
+    }
+    return uploader.PutObject(ctx, data)
+}
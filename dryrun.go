@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+    // how much of each file is compressed to estimate the ratio, and the overall budget
+    dryRunSampleBytesPerFile = 64 * KiB
+    dryRunSampleBudget       = 64 * KiB * KiB
+
+    // per entry zip overhead: local header (30) + zip64 data descriptor (24) + central directory header (46),
+    // not counting the name which is stored twice
+    zipEntryOverhead = 30 + 24 + 46
+    zipEndOverhead   = 22 + 56 + 20 // end of central directory, zip64 end record and locator
+    zipCryptoHeader  = 12
+)
+
+// DryRunEntry is one line of the dry-run output.
+type DryRunEntry struct {
+    Path        string `json:"path"`
+    ArchivePath string `json:"archive_path,omitempty"`
+    Type        string `json:"type"` // "file" or "dir"
+    Size        int64  `json:"size"`
+    Included    bool   `json:"included"`
+    Reason      string `json:"reason,omitempty"`
+}
+
+// DryRunSummary is the last line of the dry-run output.
+type DryRunSummary struct {
+    Type                     string           `json:"type"` // always "summary"
+    Destination              string           `json:"destination"`
+    Destinations             []string         `json:"destinations,omitempty"` // all of them, when several -d are given
+    Files                    int              `json:"files"`
+    Dirs                     int              `json:"dirs"`
+    Excluded                 int              `json:"excluded"`
+    UncompressedBytes        int64            `json:"uncompressed_bytes"`
+    SampledBytes             int64            `json:"sampled_bytes"`
+    EstimatedCompressedBytes int64            `json:"estimated_compressed_bytes"`
+    PartSize                 int              `json:"part_size"`
+    EstimatedParts           int64            `json:"estimated_parts"`
+    UploadMode               string           `json:"upload_mode"` // "file", "simple" or "multipart"
+    Shards                   []ShardIndexItem `json:"shards,omitempty"`
+    CredentialCheck          string           `json:"credential_check"` // "ok", "failed" or "skipped"
+    CredentialError          string           `json:"credential_error,omitempty"`
+}
+
+// compressionSampler estimates the deflate ratio by compressing the head of each file.
+type compressionSampler struct {
+    budget     int64
+    sampled    int64
+    compressed int64
+    buf        bytes.Buffer
+}
+
+// sample returns the estimated compressed size of a file, compressing up to
+// dryRunSampleBytesPerFile of it while the overall budget lasts.
+func (s *compressionSampler) sample(path string, size int64, level int) (int64, error) {
+    if level == 0 || size == 0 {
+        return size, nil
+    }
+    if s.sampled >= s.budget {
+        return int64(float64(size) * s.ratio()), nil
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+
+    s.buf.Reset()
+    fw, err := flate.NewWriter(&s.buf, level)
+    if err != nil {
+        return 0, err
+    }
+    n, err := io.Copy(fw, io.LimitReader(f, dryRunSampleBytesPerFile))
+    if err != nil {
+        return 0, err
+    }
+    if err := fw.Close(); err != nil {
+        return 0, err
+    }
+    if n == 0 {
+        return 0, nil
+    }
+
+    s.sampled += n
+    s.compressed += int64(s.buf.Len())
+    return int64(float64(size) * float64(s.buf.Len()) / float64(n)), nil
+}
+
+// ratio is the compressed/uncompressed ratio seen so far, 1 if nothing was sampled.
+func (s *compressionSampler) ratio() float64 {
+    if s.sampled == 0 {
+        return 1
+    }
+    return float64(s.compressed) / float64(s.sampled)
+}
+
+// RunDryRun walks and filters the sources like CreateZipArchive, writing one JSON line per
+// path to out, followed by a summary with the estimated archive size and number of parts.
+// For object storage destinations, credentials are validated without starting an upload.
+func RunDryRun(ctx context.Context, cfg *Config, destDetails []*DestDetails, out io.Writer) (*DryRunSummary, error) {
+    opts := cfg.ArchiveOptions()
+    filter, err := NewFilterChain(opts.IgnoreFile, opts.Filters)
+    if err != nil {
+        return nil, err
+    }
+
+    enc := json.NewEncoder(out)
+    summary := DryRunSummary{
+        Type:        "summary",
+        Destination: cfg.Destinations[0].String(),
+        PartSize:    cfg.MinPartSize,
+    }
+    if len(cfg.Destinations) > 1 {
+        for _, dest := range cfg.Destinations {
+            summary.Destinations = append(summary.Destinations, dest.String())
+        }
+    }
+    sampler := &compressionSampler{budget: dryRunSampleBudget}
+    var writeErr error
+
+    filter.OnExclude = func(path string, info os.FileInfo, reason string) {
+        entry := DryRunEntry{Path: path, Type: "file", Size: info.Size(), Reason: reason}
+        if info.IsDir() {
+            entry.Type = "dir"
+            entry.Size = 0
+        }
+        summary.Excluded++
+        if writeErr == nil {
+            writeErr = enc.Encode(entry)
+        }
+    }
+
+    estimated := int64(zipEndOverhead)
+    names := make(map[string]string) // archive name -> disk path, see addEntryToZip
+    err = walkSources(cfg.Sources, filter, func(entry archiveEntry) error {
+        line := DryRunEntry{Path: filepath.ToSlash(entry.RelPath), Type: "file"}
+        if entry.Info.IsDir() {
+            line.Type = "dir"
+            line.Path += "/"
+        } else {
+            line.Size = entry.Info.Size()
+        }
+        name, err := opts.Rewriter.Rewrite(line.Path)
+        if err != nil {
+            return err
+        }
+        line.ArchivePath, line.Included = name, name != ""
+        first, dup := names[name]
+        if dup && line.Included && !entry.Info.IsDir() {
+            return fmt.Errorf("%s and %s are both stored as %s", first, entry.Path, name)
+        }
+        if line.Included && !dup {
+            names[name] = entry.Path
+        }
+
+        switch {
+        case !line.Included:
+            line.Reason = "path rewritten to nothing"
+            summary.Excluded++
+        case dup:
+            line.Included, line.Reason = false, "directory already added"
+            summary.Excluded++
+        case entry.Info.IsDir():
+            if !strings.HasSuffix(line.ArchivePath, "/") {
+                line.ArchivePath += "/"
+            }
+            summary.Dirs++
+            estimated += zipEntryOverhead + 2*int64(len(line.ArchivePath))
+        default:
+            summary.Files++
+            summary.UncompressedBytes += line.Size
+
+            level := getCompressionLevelForFile(name, opts.CompressionLevel)
+            compressed, err := sampler.sample(entry.Path, line.Size, level)
+            if err != nil {
+                return fmt.Errorf("failed to sample %s: %v", entry.Path, err)
+            }
+            estimated += compressed + zipEntryOverhead + 2*int64(len(name))
+            if opts.Password != "" {
+                estimated += zipCryptoHeader
+            }
+        }
+
+        if err := enc.Encode(line); err != nil {
+            return err
+        }
+        return writeErr
+    })
+    if err != nil {
+        return nil, fmt.Errorf("walk error: %v", err)
+    }
+    if writeErr != nil {
+        return nil, writeErr
+    }
+
+    summary.SampledBytes = sampler.sampled
+    summary.EstimatedCompressedBytes = estimated
+    summary.EstimatedParts = (estimated + int64(cfg.MinPartSize) - 1) / int64(cfg.MinPartSize)
+
+    allLocal := true
+    for _, details := range destDetails {
+        allLocal = allLocal && details.IsLocal()
+    }
+    switch {
+    case allLocal:
+        summary.UploadMode = "file"
+    case summary.EstimatedParts <= 1:
+        summary.UploadMode = "simple"
+    default:
+        summary.UploadMode = "multipart"
+    }
+
+    if cfg.ShardBy != "" {
+        shards, err := PlanShards(cfg.Sources, opts, cfg.ShardBy, cfg.ShardSize)
+        if err != nil {
+            return nil, fmt.Errorf("failed to plan shards: %v", err)
+        }
+        for _, shard := range shards {
+            summary.Shards = append(summary.Shards, ShardIndexItem{
+                Name:              shard.Name,
+                Key:               shardKey(destDetails[0].Key, shard.Name),
+                Files:             shard.Files,
+                Dirs:              shard.Dirs,
+                UncompressedBytes: shard.Size,
+            })
+        }
+    }
+
+    summary.CredentialCheck = "skipped"
+    for _, details := range destDetails {
+        if details.IsLocal() {
+            continue
+        }
+        if summary.CredentialCheck == "skipped" {
+            summary.CredentialCheck = "ok"
+        }
+        if err := checkDestinationAccess(ctx, details, cfg.AuthType); err != nil {
+            summary.CredentialCheck = "failed"
+            summary.CredentialError = err.Error()
+            if len(destDetails) > 1 {
+                summary.CredentialError = fmt.Sprintf("%s: %v", details, err)
+            }
+            break
+        }
+    }
+
+    return &summary, enc.Encode(summary)
+}
+
+// checkDestinationAccess validates credentials for an object storage destination.
+func checkDestinationAccess(ctx context.Context, details *DestDetails, authType string) error {
+    uploader, err := NewUploader(details, authType)
+    if err != nil {
+        return err
+    }
+    checker, ok := uploader.(AccessChecker)
+    if !ok {
+        slog.Warn("Uploader can't validate access, skipping credential check", "provider", details.Provider)
+        return nil
+    }
+    return checker.CheckAccess(ctx)
+}
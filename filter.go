@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// FilterRule is one step of the filter chain evaluated for every walked path.
+type FilterRule interface {
+    // Excludes reports whether the path should be left out of the archive, and why.
+    // path is the archive path, with a trailing slash for directories.
+    Excludes(path string, info os.FileInfo) (bool, string)
+}
+
+// FilterChain runs the rules in order; the first rule that excludes a path wins.
+type FilterChain struct {
+    rules   []FilterRule
+    Explain bool // log the rule that excluded each path
+    quiet   bool // don't log exclusions at all, for secondary walks
+
+    // lazyDirs is set with -include: a directory is only archived once a file below it is,
+    // so the directories without any matching file don't show up as empty entries
+    lazyDirs bool
+
+    // OnExclude, when set, is called for every excluded path (used by -dry-run)
+    OnExclude func(path string, info os.FileInfo, reason string)
+}
+
+// Excludes reports whether any rule excludes the path, and the reason given by that rule.
+func (c *FilterChain) Excludes(path string, info os.FileInfo) (bool, string) {
+    if c == nil {
+        return false, ""
+    }
+    for _, rule := range c.rules {
+        if excluded, reason := rule.Excludes(path, info); excluded {
+            return true, reason
+        }
+    }
+    return false, ""
+}
+
+// dirAwareRule is implemented by rules that need to see every directory the walk descends into.
+type dirAwareRule interface {
+    enterDir(diskDir string, archiveDir string) error
+}
+
+// EnterDir must be called for the source root and for every directory that was not excluded,
+// before any of its contents are checked.
+func (c *FilterChain) EnterDir(diskDir string, archiveDir string) error {
+    if c == nil {
+        return nil
+    }
+    for _, rule := range c.rules {
+        if r, ok := rule.(dirAwareRule); ok {
+            if err := r.enterDir(diskDir, archiveDir); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// FilterOptions holds the selection flags on top of the ignore file.
+type FilterOptions struct {
+    Includes  []string // gitignore-style patterns, files must match at least one
+    Excludes  []string // gitignore-style patterns, like extra lines of the ignore file
+    MinSize   int64    // bytes, 0 means no limit
+    MaxSize   int64    // bytes, 0 means no limit
+    NewerThan time.Time
+    OlderThan time.Time
+    Explain   bool
+
+    // per-directory ignore file names (e.g. .tsyncignore) discovered during the walk
+    NestedIgnoreFiles []string
+}
+
+// NewFilterChain builds the chain from the ignore file and the filter options.
+func NewFilterChain(ignoreFile string, opts FilterOptions) (*FilterChain, error) {
+    chain := &FilterChain{Explain: opts.Explain}
+
+    var fileRule *ignoreRule
+    if ignoreFile != "" {
+        gi, err := CompileIgnoreFile(ignoreFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to compile ignore file: %v", err)
+        }
+        fileRule = &ignoreRule{gi, ignoreFile}
+    }
+    if len(opts.NestedIgnoreFiles) > 0 {
+        // per-directory files take precedence over -ignore-file, like .gitignore over core.excludesFile
+        chain.rules = append(chain.rules, newNestedIgnoreRule(opts.NestedIgnoreFiles, fileRule))
+    } else if fileRule != nil {
+        chain.rules = append(chain.rules, fileRule)
+    }
+    if len(opts.Excludes) > 0 {
+        chain.rules = append(chain.rules, &ignoreRule{CompileIgnoreLines(opts.Excludes...), ""})
+    }
+    if len(opts.Includes) > 0 {
+        chain.rules = append(chain.rules, &includeRule{CompileIgnoreLines(opts.Includes...)})
+        chain.lazyDirs = true
+    }
+    if opts.MinSize > 0 || opts.MaxSize > 0 {
+        chain.rules = append(chain.rules, &sizeRule{opts.MinSize, opts.MaxSize})
+    }
+    if !opts.NewerThan.IsZero() || !opts.OlderThan.IsZero() {
+        chain.rules = append(chain.rules, &ageRule{opts.NewerThan, opts.OlderThan})
+    }
+
+    return chain, nil
+}
+
+// ignoreRule excludes paths matched by gitignore-style patterns, either from an ignore file
+// or from the -exclude flags when file is empty.
+type ignoreRule struct {
+    gi   *GitIgnore
+    file string
+}
+
+func (r *ignoreRule) Excludes(path string, info os.FileInfo) (bool, string) {
+    matches, pattern := r.gi.MatchesPathHow(path)
+    if !matches {
+        return false, ""
+    }
+    if r.file == "" {
+        return true, fmt.Sprintf("-exclude %s", pattern.Line)
+    }
+    return true, fmt.Sprintf("%s:%d: %s", r.file, pattern.LineNo, pattern.Line)
+}
+
+// includeRule keeps only files that match at least one include pattern.
+// Directories are always walked, since files below them may still match, and only
+// archived when they do, see FilterChain.lazyDirs.
+type includeRule struct {
+    gi *GitIgnore
+}
+
+func (r *includeRule) Excludes(path string, info os.FileInfo) (bool, string) {
+    if info.IsDir() || r.gi.MatchesPath(path) {
+        return false, ""
+    }
+    return true, "not matched by any -include pattern"
+}
+
+// sizeRule excludes files outside of [min, max] bytes.
+type sizeRule struct {
+    min int64
+    max int64
+}
+
+func (r *sizeRule) Excludes(path string, info os.FileInfo) (bool, string) {
+    if info.IsDir() {
+        return false, ""
+    }
+    if r.min > 0 && info.Size() < r.min {
+        return true, fmt.Sprintf("size %d bytes is below -min-file-size %d", info.Size(), r.min)
+    }
+    if r.max > 0 && info.Size() > r.max {
+        return true, fmt.Sprintf("size %d bytes is above -max-file-size %d", info.Size(), r.max)
+    }
+    return false, ""
+}
+
+// ageRule excludes files by modification time.
+type ageRule struct {
+    newerThan time.Time
+    olderThan time.Time
+}
+
+func (r *ageRule) Excludes(path string, info os.FileInfo) (bool, string) {
+    if info.IsDir() {
+        return false, ""
+    }
+    mtime := info.ModTime()
+    if !r.newerThan.IsZero() && !mtime.After(r.newerThan) {
+        return true, fmt.Sprintf("modified %s, not newer than %s", mtime.Format(time.RFC3339), r.newerThan.Format(time.RFC3339))
+    }
+    if !r.olderThan.IsZero() && !mtime.Before(r.olderThan) {
+        return true, fmt.Sprintf("modified %s, not older than %s", mtime.Format(time.RFC3339), r.olderThan.Format(time.RFC3339))
+    }
+    return false, ""
+}
+
+// parseTimeOrAge parses either an age relative to now ("36h", "7d") or an absolute
+// timestamp (RFC3339, "2006-01-02T15:04:05" or "2006-01-02", local time).
+func parseTimeOrAge(value string, now time.Time) (time.Time, error) {
+    if strings.HasSuffix(value, "d") {
+        var days int
+        if _, err := fmt.Sscanf(value, "%dd", &days); err == nil {
+            if days < 0 {
+                return time.Time{}, fmt.Errorf("invalid age %q, it must not be negative", value)
+            }
+            return now.Add(-time.Duration(days) * 24 * time.Hour), nil
+        }
+    }
+    if d, err := time.ParseDuration(value); err == nil {
+        if d < 0 {
+            return time.Time{}, fmt.Errorf("invalid age %q, it must not be negative", value)
+        }
+        return now.Add(-d), nil
+    }
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02"} {
+        if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, fmt.Errorf("invalid time %q, expected a duration like 36h or 7d, or a timestamp like 2026-10-17", value)
+}
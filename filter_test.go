@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseTimeOrAge(t *testing.T) {
+    now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        in      string
+        want    time.Time
+        wantErr bool
+    }{
+        {"7d", now.AddDate(0, 0, -7), false},
+        {"0d", now, false},
+        {"36h", now.Add(-36 * time.Hour), false},
+        {"90m", now.Add(-90 * time.Minute), false},
+        {"1h30m", now.Add(-90 * time.Minute), false},
+        {"2026-10-17T08:30:00Z", time.Date(2026, 10, 17, 8, 30, 0, 0, time.UTC), false},
+        {"2026-10-17T08:30:00+02:00", time.Date(2026, 10, 17, 6, 30, 0, 0, time.UTC), false},
+        {"2026-10-17T08:30:00", time.Date(2026, 10, 17, 8, 30, 0, 0, time.Local), false},
+        {"2026-10-17", time.Date(2026, 10, 17, 0, 0, 0, 0, time.Local), false},
+        {"", time.Time{}, true},
+        {"d", time.Time{}, true},
+        {"7days", time.Time{}, true},
+        {"1w", time.Time{}, true},
+        {"yesterday", time.Time{}, true},
+        {"2026-13-01", time.Time{}, true},
+        {"17/10/2026", time.Time{}, true},
+        // a negative age would be in the future and exclude every file
+        {"-3d", time.Time{}, true},
+        {"-36h", time.Time{}, true},
+        {"-1h30m", time.Time{}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.in, func(t *testing.T) {
+            got, err := parseTimeOrAge(tt.in, now)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("parseTimeOrAge(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+            }
+            if !got.Equal(tt.want) {
+                t.Errorf("parseTimeOrAge(%q) = %v, want %v", tt.in, got, tt.want)
+            }
+        })
+    }
+}
+
+// writeTree creates the files under root, with parent directories as needed.
+func writeTree(t *testing.T, root string, files map[string]string) {
+    t.Helper()
+    for name, content := range files {
+        path := filepath.Join(root, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestNestedIgnorePrecedence(t *testing.T) {
+    tests := []struct {
+        name       string
+        files      map[string]string
+        ignoreFile string // contents of -ignore-file, none when empty
+        want       []string
+    }{
+        {
+            name: "deepest file with a match decides",
+            files: map[string]string{
+                ".tsyncignore":     "*.log\n",
+                "a.log":            "",
+                "sub/.tsyncignore": "!keep.log\n",
+                "sub/keep.log":     "",
+                "sub/other.log":    "",
+            },
+            want: []string{".tsyncignore", "sub/", "sub/.tsyncignore", "sub/keep.log"},
+        },
+        {
+            name: "last matching line wins",
+            files: map[string]string{
+                ".tsyncignore": "*.tmp\n!x.tmp\n",
+                "x.tmp":        "",
+                "y.tmp":        "",
+            },
+            want: []string{".tsyncignore", "x.tmp"},
+        },
+        {
+            name: "tsyncignore over gitignore in the same directory",
+            files: map[string]string{
+                ".gitignore":   "*.txt\n",
+                ".tsyncignore": "!a.txt\n",
+                "a.txt":        "",
+                "b.txt":        "",
+            },
+            want: []string{".gitignore", ".tsyncignore", "a.txt"},
+        },
+        {
+            name: "ignore file is the fallback",
+            files: map[string]string{
+                "top.bak":          "",
+                "sub/.tsyncignore": "!keep.bak\n",
+                "sub/keep.bak":     "",
+                "sub/drop.bak":     "",
+            },
+            ignoreFile: "*.bak\n",
+            want:       []string{"sub/", "sub/.tsyncignore", "sub/keep.bak"},
+        },
+        {
+            name: "excluded directory can't be re-included",
+            files: map[string]string{
+                ".tsyncignore":       "build/\n",
+                "build/.tsyncignore": "!*\n",
+                "build/out.bin":      "",
+                "src/main.go":        "",
+            },
+            want: []string{".tsyncignore", "src/", "src/main.go"},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            root := t.TempDir()
+            writeTree(t, root, tt.files)
+            ignoreFile := ""
+            if tt.ignoreFile != "" {
+                ignoreFile = filepath.Join(t.TempDir(), "ignore")
+                if err := os.WriteFile(ignoreFile, []byte(tt.ignoreFile), 0o644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            filter, err := NewFilterChain(ignoreFile, FilterOptions{
+                NestedIgnoreFiles: []string{GitIgnoreFileName, TsyncIgnoreFileName},
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+            var got []string
+            err = walkSources([]ArchiveSource{{Path: root}}, filter, func(entry archiveEntry) error {
+                if entry.RelPath == "" {
+                    return nil // the source root, stored without a name
+                }
+                name := filepath.ToSlash(entry.RelPath)
+                if entry.Info.IsDir() {
+                    name += "/"
+                }
+                got = append(got, name)
+                return nil
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+            sort.Strings(got)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("archived %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"t-sync/storage_clients"
+)
+
+// GetCommand is the name of the subcommand that downloads an object.
+const GetCommand = "get"
+
+const (
+    DefaultGetChunkSizeInMiB = 16
+    DefaultGetConcurrency    = 8
+)
+
+// GetConfig holds the flags of the get command.
+type GetConfig struct {
+    Source      *url.URL
+    Output      string // file path, or "-" for stdout
+    AuthType    string
+    ChunkSize   int64
+    Concurrency int
+    Limit       *BandwidthLimiter // nil for unlimited
+    LogFormat   string
+    LogLevel    string
+    RetryPolicy storage_clients.RetryPolicy
+}
+
+// ParseGetFlags parses the flags of `t-sync get`. Flags may come before or after the
+// object URI.
+func ParseGetFlags(args []string) (*GetConfig, error) {
+    cfg := &GetConfig{}
+    flags := flag.NewFlagSet(GetCommand, flag.ExitOnError)
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "Usage: %s %s <object URI> -o <file> [flags]\n\nDownloads an object with parallel ranged reads, to a file or to stdout with '-o -'.\n\n", os.Args[0], GetCommand)
+        flags.PrintDefaults()
+    }
+
+    var chunkSizeMiB int
+    var bwLimit string
+    flags.StringVar(&cfg.Output, "o", "", "Output file, or '-' for stdout.")
+    flags.StringVar(&cfg.AuthType, "auth-type", "", "Authentication type, as for an upload.")
+    flags.IntVar(&chunkSizeMiB, "chunk-size-mb", DefaultGetChunkSizeInMiB, "Size in MB of the ranges read in parallel.")
+    flags.IntVar(&cfg.Concurrency, "concurrency", DefaultGetConcurrency, "Number of ranges read in parallel. Memory is capped at this many ranges of -chunk-size-mb.")
+    flags.StringVar(&bwLimit, "bwlimit", "", "Limit the download bandwidth, same format as for an upload.")
+    flags.StringVar(&cfg.LogFormat, "log-format", LogFormatText, "Log format on stderr: text or json.")
+    flags.StringVar(&cfg.LogLevel, "log-level", "info", "Log level: debug, info, warn or error.")
+    addRetryFlags(flags, &cfg.RetryPolicy)
+
+    flags.Parse(args)
+    var srcStr string
+    if flags.NArg() > 0 {
+        srcStr = flags.Arg(0)
+        flags.Parse(flags.Args()[1:])
+    }
+    if flags.NArg() > 0 {
+        flags.Usage()
+        return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+    }
+
+    if srcStr == "" {
+        flags.Usage()
+        return nil, fmt.Errorf("object URI is required")
+    }
+    srcURL, err := url.Parse(srcStr)
+    if err != nil {
+        flags.Usage()
+        return nil, fmt.Errorf("invalid object URI: %v", err)
+    }
+    cfg.Source = srcURL
+
+    if cfg.Output == "" {
+        flags.Usage()
+        return nil, fmt.Errorf("output is required, use '-o -' for stdout")
+    }
+    if chunkSizeMiB < 1 {
+        flags.Usage()
+        return nil, fmt.Errorf("chunk-size-mb must be at least 1")
+    }
+    cfg.ChunkSize = int64(chunkSizeMiB) * KiB * KiB
+    if cfg.Concurrency < 1 {
+        flags.Usage()
+        return nil, fmt.Errorf("concurrency must be at least 1")
+    }
+
+    if cfg.Limit, err = ParseBandwidthLimit(bwLimit); err != nil {
+        flags.Usage()
+        return nil, fmt.Errorf("invalid bwlimit: %v", err)
+    }
+    if err := validateRetryPolicy(cfg.RetryPolicy); err != nil {
+        flags.Usage()
+        return nil, err
+    }
+    return cfg, nil
+}
+
+// RunGet downloads the object to cfg.Output, or to stdout when it's "-". The output file
+// only appears once the download is complete. It returns an exit code.
+func RunGet(ctx context.Context, cfg *GetConfig, stdout io.Writer) (int, error) {
+    details, err := ParseDestURL(cfg.Source)
+    if err != nil {
+        return ExitCodeInvalidParameters, err
+    }
+    if details.IsLocal() {
+        return ExitCodeInvalidParameters, fmt.Errorf("get needs an object storage URI, not a local file")
+    }
+    if details.Key == "" {
+        return ExitCodeInvalidParameters, fmt.Errorf("an object key is required")
+    }
+    if f, ok := stdout.(*os.File); ok && cfg.Output == "-" && isTerminal(f) {
+        return ExitCodeInvalidParameters, fmt.Errorf("refusing to write the object to a terminal, pipe it into another command")
+    }
+
+    uploader, err := NewUploader(details, cfg.AuthType)
+    if err != nil {
+        return ExitCodeUploaderClientFailed, fmt.Errorf("failed to create client: %v", err)
+    }
+    downloader, ok := uploader.(ObjectDownloader)
+    if !ok {
+        return ExitCodeInvalidParameters, fmt.Errorf("provider '%s' can't read objects", details.Provider)
+    }
+
+    stat, err := downloader.StatObject(ctx)
+    if err != nil {
+        return downloadFailedCode(ctx, err), err
+    }
+    slog.Info("Downloading object", "source", cfg.Source.String(), "output", cfg.Output, "bytes", stat.Size, "chunk_size_mb", cfg.ChunkSize/KiB/KiB, "concurrency", cfg.Concurrency)
+
+    start := time.Now()
+    if cfg.Output == "-" {
+        err = downloadObject(ctx, downloader, stat, stdout, cfg)
+    } else {
+        err = downloadToFile(ctx, downloader, stat, cfg)
+    }
+    if err != nil {
+        return downloadFailedCode(ctx, err), err
+    }
+
+    elapsed := time.Since(start)
+    slog.Info("Object downloaded", "bytes", stat.Size, "elapsed", elapsed, "mib_per_second", float64(stat.Size)/KiB/KiB/elapsed.Seconds())
+    return 0, nil
+}
+
+// downloadToFile downloads the object into cfg.Output through a partial file, which is
+// renamed once the download is complete and removed when it fails.
+func downloadToFile(ctx context.Context, d ObjectDownloader, stat storage_clients.ObjectStat, cfg *GetConfig) error {
+    file, err := createPartialFile(cfg.Output)
+    if err != nil {
+        return fmt.Errorf("failed to create output file: %w", err)
+    }
+    if err := downloadObject(ctx, d, stat, file.File, cfg); err != nil {
+        file.discard()
+        return err
+    }
+    if err := file.commit(); err != nil {
+        file.discard()
+        return err
+    }
+    return nil
+}
+
+// downloadRange is a range of the object being read, done is closed once data or err is set.
+type downloadRange struct {
+    start, end int64 // inclusive
+    data       []byte
+    err        error
+    done       chan struct{}
+}
+
+// downloadObject reads the object in ranges of cfg.ChunkSize, cfg.Concurrency of them at
+// a time. Ranges are written with WriteAt as they arrive when out is a regular file, and
+// in order otherwise. Either way at most cfg.Concurrency ranges are held in memory.
+func downloadObject(ctx context.Context, d ObjectDownloader, stat storage_clients.ObjectStat, out io.Writer, cfg *GetConfig) error {
+    ctx, cancel := context.WithCancelCause(ctx)
+    defer cancel(nil)
+    if cfg.Limit != nil {
+        // every attempt pays for the bytes it receives, as they arrive
+        ctx = storage_clients.WithBodyWrapper(ctx, func(ctx context.Context, body io.Reader) io.Reader {
+            return cfg.Limit.LimitReader(ctx, body)
+        })
+    }
+
+    file, _ := out.(*os.File)
+    if file != nil {
+        if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+            file = nil
+        }
+    }
+
+    // A range holds its slot until it's written
+    slots := make(chan struct{}, cfg.Concurrency)
+    ordered := make(chan *downloadRange, cfg.Concurrency)
+    writerDone := make(chan struct{})
+    go func() {
+        defer close(writerDone)
+        for r := range ordered {
+            <-r.done
+            if r.err == nil && ctx.Err() == nil {
+                if _, err := out.Write(r.data); err != nil {
+                    cancel(fmt.Errorf("failed to write output: %w", err))
+                }
+            }
+            r.data = nil
+            <-slots
+        }
+    }()
+
+    var wg sync.WaitGroup
+dispatch:
+    for start := int64(0); start < stat.Size && ctx.Err() == nil; start += cfg.ChunkSize {
+        select {
+        case slots <- struct{}{}:
+        case <-ctx.Done():
+            break dispatch
+        }
+        r := &downloadRange{start: start, end: min(start+cfg.ChunkSize, stat.Size) - 1, done: make(chan struct{})}
+        if file == nil {
+            // never blocks, the channel has room for every range holding a slot
+            ordered <- r
+        }
+
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            defer close(r.done)
+            var err error
+            r.data, err = d.GetObjectRange(ctx, r.start, r.end, stat.ETag)
+            if err == nil && file != nil {
+                if _, err = file.WriteAt(r.data, r.start); err != nil {
+                    err = fmt.Errorf("failed to write output: %w", err)
+                }
+                r.data = nil
+                <-slots
+            }
+            if err != nil {
+                r.err = err
+                cancel(err)
+            }
+        }()
+    }
+    wg.Wait()
+    close(ordered)
+    <-writerDone
+
+    return context.Cause(ctx)
+}
+
+// downloadFailedCode maps a failed download to an exit code: a missing object is a
+// missing source.
+func downloadFailedCode(ctx context.Context, err error) int {
+    if interrupted(ctx) != nil {
+        return ExitCodeInterrupted
+    }
+    var retryErr *storage_clients.RetryError
+    if errors.As(err, &retryErr) && retryErr.Class == storage_clients.ErrorClassNotFound {
+        return ExitCodeSourceDirNotFound
+    }
+    return uploadFailedCode(err)
+}
+
+// runGetCommand is the entry point of `t-sync get`.
+func runGetCommand(args []string) {
+    cfg, err := ParseGetFlags(args)
+    if err != nil {
+        exitWithErrorCode(ExitCodeInvalidParameters, "Configuration error: %v", err)
+    }
+    if err := setupLogging(os.Stderr, cfg.LogFormat, cfg.LogLevel, false); err != nil {
+        exitWithErrorCode(ExitCodeInvalidParameters, "Configuration error: %v", err)
+    }
+
+    storage_clients.SetRetryPolicy(cfg.RetryPolicy)
+
+    ctx, stopSignals := withSignals(context.Background())
+    defer stopSignals()
+    if code, err := RunGet(ctx, cfg, os.Stdout); err != nil {
+        exitWithErrorCode(code, "Download failed: %v", err)
+    }
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"t-sync/storage_clients"
+)
+
+// fakeObject serves ranges of data with random delays, so they complete out of order, and
+// fails reads whose ifMatch isn't the current ETag like a storage service with If-Match.
+type fakeObject struct {
+    data []byte
+
+    mu   sync.Mutex
+    etag string
+    // replaceAfter changes the ETag after that many ranges were read, 0 never does
+    replaceAfter int
+    reads        int
+
+    inFlight, maxInFlight atomic.Int32
+}
+
+func (o *fakeObject) StatObject(ctx context.Context) (storage_clients.ObjectStat, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    return storage_clients.ObjectStat{Size: int64(len(o.data)), ETag: o.etag}, nil
+}
+
+func (o *fakeObject) GetObjectRange(ctx context.Context, startByte, endByte int64, ifMatch string) ([]byte, error) {
+    n := o.inFlight.Add(1)
+    defer o.inFlight.Add(-1)
+    for {
+        max := o.maxInFlight.Load()
+        if n <= max || o.maxInFlight.CompareAndSwap(max, n) {
+            break
+        }
+    }
+    time.Sleep(time.Duration(rand.Intn(3000)) * time.Microsecond)
+
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if ifMatch != o.etag {
+        return nil, &storage_clients.RetryError{Op: "get object range", Attempts: 1, Class: storage_clients.ErrorClassClient,
+            Err: fmt.Errorf("precondition failed: ETag is %s, not %s", o.etag, ifMatch)}
+    }
+    o.reads++
+    if o.replaceAfter > 0 && o.reads == o.replaceAfter {
+        o.etag = "replaced"
+    }
+    return append([]byte(nil), o.data[startByte:endByte+1]...), nil
+}
+
+func newFakeObject(size int) *fakeObject {
+    data := make([]byte, size)
+    rand.New(rand.NewSource(1)).Read(data)
+    return &fakeObject{data: data, etag: "v1"}
+}
+
+func TestDownloadObjectOrder(t *testing.T) {
+    tests := []struct {
+        name      string
+        size      int
+        chunkSize int64
+    }{
+        {"many ranges", 1000, 7},
+        {"exact multiple", 64, 16},
+        {"single range", 10, 100},
+        {"empty object", 0, 16},
+    }
+    for _, tt := range tests {
+        for _, toFile := range []bool{false, true} {
+            t.Run(fmt.Sprintf("%s/file=%v", tt.name, toFile), func(t *testing.T) {
+                object := newFakeObject(tt.size)
+                stat, _ := object.StatObject(context.Background())
+                cfg := &GetConfig{ChunkSize: tt.chunkSize, Concurrency: 4}
+
+                var got []byte
+                if toFile {
+                    cfg.Output = filepath.Join(t.TempDir(), "out")
+                    if err := downloadToFile(context.Background(), object, stat, cfg); err != nil {
+                        t.Fatal(err)
+                    }
+                    var err error
+                    if got, err = os.ReadFile(cfg.Output); err != nil {
+                        t.Fatal(err)
+                    }
+                } else {
+                    // not a regular file: the ranges are written in order
+                    var out bytes.Buffer
+                    if err := downloadObject(context.Background(), object, stat, &out, cfg); err != nil {
+                        t.Fatal(err)
+                    }
+                    got = out.Bytes()
+                }
+
+                if !bytes.Equal(got, object.data) {
+                    t.Errorf("downloaded %d bytes that differ from the %d bytes of the object", len(got), len(object.data))
+                }
+                if max := object.maxInFlight.Load(); max > int32(cfg.Concurrency) {
+                    t.Errorf("%d ranges read at once, want at most %d", max, cfg.Concurrency)
+                }
+            })
+        }
+    }
+}
+
+func TestDownloadObjectReplacedDuringDownload(t *testing.T) {
+    for _, toFile := range []bool{false, true} {
+        t.Run(fmt.Sprintf("file=%v", toFile), func(t *testing.T) {
+            object := newFakeObject(1000)
+            object.replaceAfter = 3
+            stat, _ := object.StatObject(context.Background())
+            cfg := &GetConfig{ChunkSize: 10, Concurrency: 2}
+
+            var err error
+            if toFile {
+                cfg.Output = filepath.Join(t.TempDir(), "out")
+                err = downloadToFile(context.Background(), object, stat, cfg)
+                for _, name := range []string{cfg.Output, cfg.Output + partialSuffix} {
+                    if _, statErr := os.Stat(name); !os.IsNotExist(statErr) {
+                        t.Errorf("%s left behind after a failed download", name)
+                    }
+                }
+            } else {
+                err = downloadObject(context.Background(), object, stat, &bytes.Buffer{}, cfg)
+            }
+
+            var retryErr *storage_clients.RetryError
+            if !errors.As(err, &retryErr) || retryErr.Class != storage_clients.ErrorClassClient {
+                t.Fatalf("err = %v, want the precondition failure of the read", err)
+            }
+            if code := downloadFailedCode(context.Background(), err); code != ExitCodeUploadFailed {
+                t.Errorf("exit code = %d, want %d", code, ExitCodeUploadFailed)
+            }
+        })
+    }
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+    LogFormatText = "text"
+    LogFormatJSON = "json"
+)
+
+// parseLogLevel maps the -log-level flag to a slog level.
+func parseLogLevel(level string) (slog.Level, error) {
+    switch strings.ToLower(level) {
+    case "debug":
+        return slog.LevelDebug, nil
+    case "info", "":
+        return slog.LevelInfo, nil
+    case "warn", "warning":
+        return slog.LevelWarn, nil
+    case "error":
+        return slog.LevelError, nil
+    }
+    return 0, fmt.Errorf("unsupported log-level: %s, expected debug, info, warn or error", level)
+}
+
+// setupLogging installs the default slog logger used by t-sync and the storage clients.
+// -quiet only lets errors through, whatever the level. Per-file and per-part messages are
+// logged at debug level so large trees don't flood the log pipeline.
+func setupLogging(out io.Writer, format string, level string, quiet bool) error {
+    lvl, err := parseLogLevel(level)
+    if err != nil {
+        return err
+    }
+    if quiet {
+        lvl = slog.LevelError
+    }
+
+    handlerOpts := &slog.HandlerOptions{Level: lvl}
+    var handler slog.Handler
+    switch format {
+    case LogFormatText, "":
+        handler = slog.NewTextHandler(out, handlerOpts)
+    case LogFormatJSON:
+        handler = slog.NewJSONHandler(out, handlerOpts)
+    default:
+        return fmt.Errorf("unsupported log-format: %s, expected text or json", format)
+    }
+
+    slog.SetDefault(slog.New(handler))
+    return nil
+}
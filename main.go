@@ -2,35 +2,87 @@ package main
 
 import (
 	"context"
-	"io"
-	"log"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
-	"path/filepath"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+
+	"t-sync/storage_clients"
+	"t-sync/tracing"
 )
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == CleanupCommand {
+        runCleanupCommand(os.Args[2:])
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == GetCommand {
+        runGetCommand(os.Args[2:])
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == PutCommand {
+        os.Args = append([]string{os.Args[0], "-raw"}, os.Args[2:]...)
+    }
+
     cfg, err := ParseFlags()
     if err != nil {
         exitWithErrorCode(ExitCodeInvalidParameters, "Configuration error: %v", err)
     }
 
-	log.Printf("Source Directory: %s\n", cfg.Source)
-	log.Printf("Destination: %s\n", cfg.Destination)
-    log.Printf("Part size in MB: %d\n", cfg.MinPartSize/1024/1024)
-    log.Printf("Max parts in memory: %d\n", cfg.MaxPartsInMemory)
+    if err := setupLogging(os.Stderr, cfg.LogFormat, cfg.LogLevel, cfg.Quiet); err != nil {
+        exitWithErrorCode(ExitCodeInvalidParameters, "Configuration error: %v", err)
+    }
+    storage_clients.SetRetryPolicy(cfg.RetryPolicy)
+
+    for _, src := range cfg.Sources {
+        slog.Info("Source", "source", src.Path, "prefix", src.Prefix)
+    }
+    for _, dest := range cfg.Destinations {
+        slog.Info("Destination", "destination", dest.String())
+    }
+    slog.Info("Upload settings", "part_size_mb", cfg.MinPartSize/1024/1024, "max_parts_in_memory", cfg.MaxPartsInMemory, "upload_concurrency", cfg.PartConcurrency, "auto_concurrency", cfg.AutoConcurrency)
+
+    var destDetails []*DestDetails
+    for _, dest := range cfg.Destinations {
+        details, err := ParseDestURL(dest)
+        if err != nil {
+            exitWithErrorCode(ExitCodeInvalidParameters, "Invalid destination: %v", err)
+        }
+        if details.Key == "" {
+            exitWithErrorCode(ExitCodeInvalidParameters, "Invalid destination %s: an object key or file path is required", dest)
+        }
+        destDetails = append(destDetails, details)
+    }
+
+    for _, details := range destDetails {
+        if details.Provider == "stdout" && !cfg.DryRun {
+            if isTerminal(os.Stdout) {
+                exitWithErrorCode(ExitCodeInvalidParameters, "Refusing to write the archive to a terminal, pipe it into another command")
+            }
+            // a reader that goes away fails the write instead of killing the process,
+            // so uploads to other destinations are aborted
+            signal.Ignore(syscall.SIGPIPE)
+        }
+    }
 
-	info, err := os.Stat(cfg.Source)
-	if err != nil {
-		if os.IsNotExist(err) {
-			exitWithErrorCode(ExitCodeSourceDirNotFound, "Source directory does not exist: %v", err)
-		}
-		exitWithErrorCode(ExitCodeInvalidParameters, "Failed to access source directory: %v", err)
-	}
-	if !info.IsDir() {
-		exitWithErrorCode(ExitCodeInvalidParameters, "Source path is not a directory: %v", cfg.Source)
-	}
+    for _, src := range cfg.Sources {
+        if src.Path == StdinSource {
+            if isTerminal(os.Stdin) {
+                exitWithErrorCode(ExitCodeInvalidParameters, "Refusing to read the source from a terminal, pipe the data into -s -")
+            }
+            continue
+        }
+        if _, err := os.Stat(src.Path); err != nil {
+            if os.IsNotExist(err) {
+                exitWithErrorCode(ExitCodeSourceDirNotFound, "Source does not exist: %v", err)
+            }
+            exitWithErrorCode(ExitCodeInvalidParameters, "Failed to access source: %v", err)
+        }
+    }
 
     // this is for cpu profiling. dev only
     // profileFileName := "cpu.prof"
@@ -46,64 +98,112 @@ func main() {
 
     start := time.Now()
 
-    var writer io.Writer
-    var closer io.Closer
-    var uploadWg sync.WaitGroup
-    var uploadErr error
+    if cfg.DryRun {
+        summary, err := RunDryRun(context.Background(), cfg, destDetails, os.Stdout)
+        if err != nil {
+            exitWithErrorCode(ExitCodeZipArchiverFailed, "Dry run failed: %v", err)
+        }
+        if summary.CredentialCheck == "failed" {
+            exitWithErrorCode(ExitCodeAuthenticationFailed, "Credential check failed: %s", summary.CredentialError)
+        }
+        slog.Info("Dry run finished", "elapsed", time.Since(start))
+        return
+    }
 
-    destDetails, err := ParseDestURL(cfg.Destination)
-    if err != nil {
-        exitWithErrorCode(ExitCodeInvalidParameters, "Invalid destination: %v", err)
+    stats := NewRunStats()
+    progress := NewProgress(cfg.Progress, cfg.ProgressInterval, stats)
+    progress.Start()
+
+    var metricsServer *http.Server
+    if cfg.MetricsAddr != "" {
+        if metricsServer, err = StartMetricsServer(cfg.MetricsAddr, stats); err != nil {
+            exitWithErrorCode(ExitCodeInvalidParameters, "%v", err)
+        }
     }
 
-    if destDetails.Provider == "file" {
-        absOutFile, err := filepath.Abs(destDetails.Key)
-        log.Printf("Output File: %s\n", absOutFile)
-        if err != nil {
-            exitWithErrorCode(ExitCodeInvalidParameters, "failed to resolve absolute path for output file: %v", err)
+    ctx := context.Background()
+    var tracer *tracing.Exporter
+    if cfg.OTLPEndpoint != "" {
+        if tracer, err = tracing.Setup(cfg.OTLPEndpoint, cfg.ServiceName, cfg.OTLPHeaders); err != nil {
+            exitWithErrorCode(ExitCodeInvalidParameters, "%v", err)
         }
-        if mkdirErr := os.MkdirAll(filepath.Dir(absOutFile), os.ModePerm); mkdirErr != nil {
-            exitWithErrorCode(ExitCodeInvalidParameters, "failed to create output directory: %v", mkdirErr)
+    }
+    var destNames []string
+    for _, dest := range cfg.Destinations {
+        destNames = append(destNames, dest.String())
+    }
+    ctx, runSpan := tracing.Start(ctx, "t-sync", tracing.String("destination", strings.Join(destNames, ",")))
+    if runSpan != nil {
+        slog.Info("Tracing run", "trace_id", runSpan.TraceID())
+    }
+    ctx, stopSignals := withSignals(ctx)
+    defer stopSignals()
+
+    reporter := NewReporter(cfg, destDetails, stats, start)
+    finish := func(code int, message string) {
+        progress.Stop()
+        runSpan.SetAttributes(tracing.Int("exit_code", int64(code)), tracing.Int("bytes_uploaded", stats.bytesUploaded.Load()))
+        if code != 0 {
+            runSpan.End(errors.New(message))
+        } else {
+            runSpan.End(nil)
         }
-        outFile, err := os.Create(absOutFile)
-        if err != nil {
-            exitWithErrorCode(ExitCodeInvalidParameters, "failed to create zip file: %v", err)
+        reporter.Write(code, message)
+        if cfg.PushgatewayURL != "" {
+            if err := PushMetrics(context.Background(), cfg.PushgatewayURL, cfg.PushgatewayJob, stats, code, time.Since(start)); err != nil {
+                slog.Warn("Failed to push metrics", "url", cfg.PushgatewayURL, "error", err)
+            }
         }
-        writer = outFile
-        closer = outFile
-    } else {
-        uploader, err := NewUploader(destDetails, cfg.AuthType)
-        if err != nil {
-            exitWithErrorCode(ExitCodeUploaderClientFailed, "Failed to create uploader: %v", err)
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        if err := tracer.Shutdown(shutdownCtx); err != nil {
+            slog.Warn("Failed to export traces", "error", err)
+        }
+        if metricsServer != nil {
+            // after the final push, so scrapes in flight finish before the process exits
+            if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+                slog.Warn("Failed to stop the metrics server", "error", err)
+            }
         }
-
-        partChan := make(chan Part, cfg.MaxPartsInMemory)
-        channelWriter := NewChannelWriter(partChan, cfg.MinPartSize)
-        writer = channelWriter
-        closer = channelWriter
-
-        uploadWg.Add(1)
-        go func() {
-            uploadErr = uploadToObjectStorage(context.Background(), uploader, partChan, &uploadWg, cfg.MaxPartsInMemory)
-        }()
     }
+    onExit(finish)
 
-    if err := CreateZipArchive(cfg.Source, writer, cfg.CompressionLevel, cfg.Password, cfg.IgnoreFile); err != nil {
-        exitWithErrorCode(ExitCodeZipArchiverFailed, "Failed to create zip archive: %v", err)
+    if cfg.ShardBy != "" {
+        code, err := runShardedArchive(ctx, cfg, destDetails[0], stats)
+        if err != nil {
+            exitWithErrorCode(code, "Sharded archive failed: %v", err)
+        }
+        finish(0, "")
+        slog.Info("Finished", "elapsed", time.Since(start))
+        return
     }
 
-    if err := closer.Close(); err != nil {
-        exitWithErrorCode(ExitCodeInternalCodeError, "Failed to close writer: %v", err)
+    dest, err := OpenTeeDestination(ctx, destDetails, cfg, stats)
+    if err != nil {
+        if _, ok := err.(*uploaderClientError); ok {
+            exitWithErrorCode(ExitCodeUploaderClientFailed, "Failed to create uploader: %v", err)
+        }
+        exitWithErrorCode(ExitCodeInvalidParameters, "%v", err)
     }
 
-    uploadWg.Wait()
+    opts := cfg.ArchiveOptions()
+    opts.Stats = stats
+    progress.PreScan(ctx, cfg.Sources, opts)
 
-    if uploadErr != nil {
-        exitWithErrorCode(ExitCodeUploadFailed, "Upload failed: %v", uploadErr)
+    var archiveErr error
+    if cfg.Raw {
+        archiveErr = CopyRaw(ctx, cfg.Sources[0], dest, opts)
+    } else {
+        archiveErr = CreateZipArchive(ctx, cfg.Sources, dest, opts)
     }
+    if code, err := finishDestination(ctx, dest, archiveErr); err != nil {
+        exitWithErrorCode(code, "Archive failed: %v", err)
+    }
+
+    finish(0, "")
 
     elapsed := time.Since(start)
-    log.Printf("Finished in %s\n", elapsed)
+    slog.Info("Finished", "elapsed", elapsed)
 
     // mem usage stats. dev only
     // var m runtime.MemStats
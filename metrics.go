@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The metrics are written in the Prometheus text exposition format by hand, which keeps
+// the client library (and its dependencies) out of the binary.
+
+// writeMetrics writes the current run stats in the Prometheus text format.
+func writeMetrics(w io.Writer, stats *RunStats) {
+    counter := func(name, help string, value int64) {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+    }
+    gauge := func(name, help string, value float64) {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+    }
+
+    counter("tsync_files_added_total", "Files added to the archive.", stats.filesAdded.Load())
+    counter("tsync_dirs_added_total", "Directories added to the archive.", stats.dirsAdded.Load())
+    counter("tsync_paths_excluded_total", "Paths excluded by ignore files and filters.", stats.excluded.Load())
+    counter("tsync_bytes_read_total", "Uncompressed bytes read from the sources.", stats.bytesRead.Load())
+    counter("tsync_bytes_compressed_total", "Bytes written to the zip stream.", stats.bytesCompressed.Load())
+    counter("tsync_bytes_uploaded_total", "Bytes uploaded to object storage.", stats.bytesUploaded.Load())
+    counter("tsync_parts_uploaded_total", "Parts uploaded to object storage.", stats.partsUploaded.Load())
+    counter("tsync_upload_retries_total", "Retried object storage calls.", stats.retries.Load())
+    gauge("tsync_parts_in_flight", "Parts currently being uploaded.", float64(stats.partsInFlight.Load()))
+    gauge("tsync_part_channel_backlog", "Parts queued in memory waiting for an upload worker.", float64(stats.PartBacklog()))
+
+    stats.mu.Lock()
+    hist := stats.partLatency
+    counts := append([]uint64(nil), hist.counts...)
+    stats.mu.Unlock()
+
+    name := "tsync_part_upload_duration_seconds"
+    fmt.Fprintf(w, "# HELP %s Time to upload a single part, including retries.\n# TYPE %s histogram\n", name, name)
+    var cumulative uint64
+    for i, bound := range partLatencyBuckets {
+        cumulative += counts[i]
+        fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+    }
+    fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, hist.count)
+    fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(hist.sum))
+    fmt.Fprintf(w, "%s_count %d\n", name, hist.count)
+}
+
+func formatFloat(v float64) string {
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// StartMetricsServer serves /metrics on addr for the duration of the run.
+func StartMetricsServer(addr string, stats *RunStats) (*http.Server, error) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        writeMetrics(w, stats)
+    })
+    server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+    go func() {
+        if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+            slog.Error("Metrics server failed", "addr", addr, "error", err)
+        }
+    }()
+    slog.Info("Serving metrics", "addr", listener.Addr().String())
+    return server, nil
+}
+
+// PushMetrics sends the final metrics of the run to a Prometheus Pushgateway. It uses POST,
+// which only replaces the pushed metric families of the job: a failed run doesn't push
+// tsync_last_success_timestamp_seconds, so the one of the last successful run is kept.
+func PushMetrics(ctx context.Context, gatewayURL, job string, stats *RunStats, exitCode int, duration time.Duration) error {
+    var body bytes.Buffer
+    writeMetrics(&body, stats)
+    fmt.Fprintf(&body, "# HELP tsync_exit_code Exit code of the last run.\n# TYPE tsync_exit_code gauge\ntsync_exit_code %d\n", exitCode)
+    fmt.Fprintf(&body, "# HELP tsync_run_duration_seconds Duration of the last run.\n# TYPE tsync_run_duration_seconds gauge\ntsync_run_duration_seconds %s\n", formatFloat(duration.Seconds()))
+    fmt.Fprintf(&body, "# HELP tsync_last_run_timestamp_seconds When the last run finished.\n# TYPE tsync_last_run_timestamp_seconds gauge\ntsync_last_run_timestamp_seconds %d\n", time.Now().Unix())
+    if exitCode == 0 {
+        fmt.Fprintf(&body, "# HELP tsync_last_success_timestamp_seconds When the last successful run finished.\n# TYPE tsync_last_success_timestamp_seconds gauge\ntsync_last_success_timestamp_seconds %d\n", time.Now().Unix())
+    }
+
+    pushURL := trimTrailingSlash(gatewayURL) + "/metrics/" + pushgatewayLabel("job", job)
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushURL, &body)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("failed to push metrics: %v", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("pushgateway returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+    }
+    return nil
+}
+
+// pushgatewayLabel encodes a label of the grouping key as a URL path segment. Values with a
+// slash can't be path escaped and use the base64 form of the Pushgateway.
+func pushgatewayLabel(name, value string) string {
+    if strings.Contains(value, "/") {
+        return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+    }
+    return name + "/" + url.PathEscape(value)
+}
+
+func trimTrailingSlash(s string) string {
+    for len(s) > 0 && s[len(s)-1] == '/' {
+        s = s[:len(s)-1]
+    }
+    return s
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// samplePattern matches a sample line of the text exposition format, with optional labels.
+var samplePattern = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*")*\})? (\S+)$`)
+
+// parseExposition checks body against the Prometheus text format: every sample belongs to
+// a family declared by a HELP and a TYPE line before it. It returns the samples by name
+// and labels, e.g. "tsync_exit_code" or `tsync_part_upload_duration_seconds_bucket{le="+Inf"}`.
+func parseExposition(t *testing.T, body string) map[string]float64 {
+    t.Helper()
+    help := make(map[string]bool)
+    types := make(map[string]string)
+    samples := make(map[string]float64)
+
+    for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+        if strings.HasPrefix(line, "# ") {
+            fields := strings.SplitN(line, " ", 4)
+            if len(fields) < 4 {
+                t.Fatalf("malformed comment line %q", line)
+            }
+            switch fields[1] {
+            case "HELP":
+                help[fields[2]] = true
+            case "TYPE":
+                switch fields[3] {
+                case "counter", "gauge", "histogram":
+                default:
+                    t.Fatalf("unknown metric type in %q", line)
+                }
+                if _, dup := types[fields[2]]; dup {
+                    t.Fatalf("TYPE of %s declared twice", fields[2])
+                }
+                types[fields[2]] = fields[3]
+            default:
+                t.Fatalf("unexpected comment line %q", line)
+            }
+            continue
+        }
+
+        m := samplePattern.FindStringSubmatch(line)
+        if m == nil {
+            t.Fatalf("malformed sample line %q", line)
+        }
+        family := m[1]
+        if types[family] == "" {
+            for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+                if base := strings.TrimSuffix(family, suffix); base != family && types[base] == "histogram" {
+                    family = base
+                }
+            }
+        }
+        if !help[family] || types[family] == "" {
+            t.Fatalf("sample %q has no HELP and TYPE before it", line)
+        }
+        value, err := strconv.ParseFloat(m[3], 64)
+        if err != nil {
+            t.Fatalf("sample %q: %v", line, err)
+        }
+        samples[m[1]+m[2]] = value
+    }
+    return samples
+}
+
+func TestPushMetrics(t *testing.T) {
+    tests := []struct {
+        name     string
+        job      string
+        exitCode int
+        wantPath string
+    }{
+        {"plain job", "t-sync", 0, "/metrics/job/t-sync"},
+        {"job with spaces", "nightly backup", 52, "/metrics/job/nightly%20backup"},
+        {"job with a slash", "team/app", 0, "/metrics/job@base64/dGVhbS9hcHA"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var method, path, contentType, body string
+            server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                method, path, contentType = r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type")
+                data, _ := io.ReadAll(r.Body)
+                body = string(data)
+                w.WriteHeader(http.StatusAccepted)
+            }))
+            defer server.Close()
+
+            stats := NewRunStats()
+            stats.FileAdded()
+            stats.FileAdded()
+            stats.DirAdded()
+            stats.ObservePartLatency(300 * time.Millisecond)
+
+            // a trailing slash on the gateway URL must not end up in the path
+            if err := PushMetrics(context.Background(), server.URL+"/", tt.job, stats, tt.exitCode, 1500*time.Millisecond); err != nil {
+                t.Fatalf("PushMetrics: %v", err)
+            }
+
+            if method != http.MethodPost {
+                t.Errorf("method = %s, want POST", method)
+            }
+            if path != tt.wantPath {
+                t.Errorf("path = %s, want %s", path, tt.wantPath)
+            }
+            if !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+                t.Errorf("content type = %q", contentType)
+            }
+
+            samples := parseExposition(t, body)
+            want := map[string]float64{
+                "tsync_files_added_total":                              2,
+                "tsync_dirs_added_total":                               1,
+                "tsync_exit_code":                                      float64(tt.exitCode),
+                "tsync_run_duration_seconds":                           1.5,
+                `tsync_part_upload_duration_seconds_bucket{le="+Inf"}`: 1,
+                "tsync_part_upload_duration_seconds_count":             1,
+                "tsync_part_upload_duration_seconds_sum":               0.3,
+            }
+            for name, value := range want {
+                if got, ok := samples[name]; !ok || got != value {
+                    t.Errorf("%s = %v (present %v), want %v", name, got, ok, value)
+                }
+            }
+            if _, ok := samples["tsync_last_success_timestamp_seconds"]; ok != (tt.exitCode == 0) {
+                t.Errorf("tsync_last_success_timestamp_seconds present = %v with exit code %d", ok, tt.exitCode)
+            }
+        })
+    }
+}
+
+// fakePushgateway keeps the pushed metric families of each group like a Pushgateway: PUT
+// replaces the whole group, POST only the families in the body.
+type fakePushgateway struct {
+    mu     sync.Mutex
+    groups map[string]map[string]string // path -> family -> HELP, TYPE and sample lines
+}
+
+func (g *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    data, _ := io.ReadAll(r.Body)
+    families := make(map[string]string)
+    var family string
+    for _, line := range strings.SplitAfter(string(data), "\n") {
+        if strings.HasPrefix(line, "# HELP ") {
+            family = strings.Fields(line)[2]
+        }
+        families[family] += line
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    path := r.URL.EscapedPath()
+    switch r.Method {
+    case http.MethodPut:
+        g.groups[path] = families
+    case http.MethodPost:
+        if g.groups[path] == nil {
+            g.groups[path] = make(map[string]string)
+        }
+        for name, lines := range families {
+            g.groups[path][name] = lines
+        }
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+}
+
+// exposition returns the metrics of a group as the Pushgateway would expose them.
+func (g *fakePushgateway) exposition(path string) string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    var body strings.Builder
+    for _, lines := range g.groups[path] {
+        body.WriteString(lines)
+    }
+    return body.String()
+}
+
+func TestPushMetricsKeepsLastSuccess(t *testing.T) {
+    gateway := &fakePushgateway{groups: make(map[string]map[string]string)}
+    server := httptest.NewServer(gateway)
+    defer server.Close()
+
+    if err := PushMetrics(context.Background(), server.URL, "t-sync", NewRunStats(), 0, time.Second); err != nil {
+        t.Fatalf("PushMetrics: %v", err)
+    }
+    success := parseExposition(t, gateway.exposition("/metrics/job/t-sync"))["tsync_last_success_timestamp_seconds"]
+    if success == 0 {
+        t.Fatal("tsync_last_success_timestamp_seconds missing after a successful run")
+    }
+
+    // a failed run must not remove the timestamp of the last successful one
+    if err := PushMetrics(context.Background(), server.URL, "t-sync", NewRunStats(), 52, time.Second); err != nil {
+        t.Fatalf("PushMetrics: %v", err)
+    }
+    samples := parseExposition(t, gateway.exposition("/metrics/job/t-sync"))
+    if got := samples["tsync_last_success_timestamp_seconds"]; got != success {
+        t.Errorf("tsync_last_success_timestamp_seconds = %v after a failed run, want %v", got, success)
+    }
+    if got := samples["tsync_exit_code"]; got != 52 {
+        t.Errorf("tsync_exit_code = %v, want 52", got)
+    }
+}
+
+func TestPushMetricsRejected(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "pushed metrics are invalid", http.StatusBadRequest)
+    }))
+    defer server.Close()
+
+    err := PushMetrics(context.Background(), server.URL, "t-sync", NewRunStats(), 0, time.Second)
+    if err == nil || !strings.Contains(err.Error(), "pushed metrics are invalid") {
+        t.Fatalf("err = %v, want the response of the gateway", err)
+    }
+}
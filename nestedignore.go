@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+    TsyncIgnoreFileName = ".tsyncignore"
+    GitIgnoreFileName   = ".gitignore"
+)
+
+// lastMatch returns the last pattern matching f, negated or not, or nil if none match.
+// Unlike MatchesPathHow this lets a caller tell "re-included by !pattern" apart from "no match".
+func (gi *GitIgnore) lastMatch(f string) *IgnorePattern {
+    var last *IgnorePattern
+    for _, ip := range gi.patterns {
+        if ip.Pattern.MatchString(f) {
+            last = ip
+        }
+    }
+    return last
+}
+
+// ignoreScope holds the ignore files found in one directory. Its patterns apply to
+// everything below base, which is the archive path of that directory.
+type ignoreScope struct {
+    base   string
+    files  []*scopedIgnoreFile
+    parent *ignoreScope
+}
+
+type scopedIgnoreFile struct {
+    path string
+    gi   *GitIgnore
+}
+
+// nestedIgnoreRule applies per-directory ignore files with git's precedence: the deepest
+// file with a matching pattern decides, the last matching line within a file wins, and the
+// -ignore-file (if any) is only consulted when no per-directory file has an opinion.
+// Negations can't re-include anything under an excluded directory, because the walk never
+// descends into it.
+type nestedIgnoreRule struct {
+    names    []string
+    fallback *ignoreRule
+    scopes   map[string]*ignoreScope // archive dir path -> scope in effect for its contents
+}
+
+func newNestedIgnoreRule(names []string, fallback *ignoreRule) *nestedIgnoreRule {
+    return &nestedIgnoreRule{
+        names:    names,
+        fallback: fallback,
+        scopes:   make(map[string]*ignoreScope),
+    }
+}
+
+// enterDir loads the ignore files of a directory the walk is about to descend into.
+func (r *nestedIgnoreRule) enterDir(diskDir string, archiveDir string) error {
+    archiveDir = cleanArchiveDir(archiveDir)
+    parent := r.scopes[cleanArchiveDir(path.Dir(archiveDir))]
+    if archiveDir == "" {
+        parent = nil
+    }
+
+    scope := &ignoreScope{base: archiveDir, parent: parent}
+    for _, name := range r.names {
+        ignorePath := filepath.Join(diskDir, name)
+        if _, err := os.Stat(ignorePath); err != nil {
+            if os.IsNotExist(err) {
+                continue
+            }
+            return err
+        }
+        gi, err := CompileIgnoreFile(ignorePath)
+        if err != nil {
+            return fmt.Errorf("failed to compile ignore file %s: %v", ignorePath, err)
+        }
+        scope.files = append(scope.files, &scopedIgnoreFile{ignorePath, gi})
+    }
+
+    if len(scope.files) == 0 {
+        // nothing new here, the parent's scope keeps applying
+        r.scopes[archiveDir] = parent
+        return nil
+    }
+    r.scopes[archiveDir] = scope
+    return nil
+}
+
+func (r *nestedIgnoreRule) Excludes(p string, info os.FileInfo) (bool, string) {
+    dir := cleanArchiveDir(path.Dir(strings.TrimSuffix(p, "/")))
+
+    for scope := r.scopes[dir]; scope != nil; scope = scope.parent {
+        rel := p
+        if scope.base != "" {
+            rel = strings.TrimPrefix(p, scope.base+"/")
+        }
+        // within a directory, later files (e.g. .tsyncignore after .gitignore) take precedence
+        for i := len(scope.files) - 1; i >= 0; i-- {
+            file := scope.files[i]
+            if ip := file.gi.lastMatch(rel); ip != nil {
+                if ip.Negate {
+                    return false, ""
+                }
+                return true, fmt.Sprintf("%s:%d: %s", file.path, ip.LineNo, ip.Line)
+            }
+        }
+    }
+
+    if r.fallback != nil {
+        return r.fallback.Excludes(p, info)
+    }
+    return false, ""
+}
+
+func cleanArchiveDir(dir string) string {
+    dir = strings.Trim(filepath.ToSlash(dir), "/")
+    if dir == "." {
+        return ""
+    }
+    return dir
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// partialSuffix is appended to the name of a local output file while it's written.
+const partialSuffix = ".partial"
+
+// partialFile is a local output file written as <name>.partial and renamed to its name
+// once complete, so a crash never leaves a truncated file under the final name. Paths
+// that exist and aren't regular files, like /dev/null or a named pipe, are written
+// directly.
+type partialFile struct {
+    *os.File
+    path      string // final path
+    direct    bool
+    committed bool
+}
+
+func createPartialFile(path string) (*partialFile, error) {
+    if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+        file, err := os.OpenFile(path, os.O_WRONLY, 0)
+        if err != nil {
+            return nil, err
+        }
+        return &partialFile{File: file, path: path, direct: true}, nil
+    }
+    file, err := os.Create(path + partialSuffix)
+    if err != nil {
+        return nil, err
+    }
+    return &partialFile{File: file, path: path}, nil
+}
+
+// commit flushes the file to disk and renames it to its final name.
+func (f *partialFile) commit() error {
+    if f.direct {
+        f.committed = true
+        return f.Close()
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return fmt.Errorf("failed to sync %s: %w", f.Name(), err)
+    }
+    if err := f.Close(); err != nil {
+        return fmt.Errorf("failed to close %s: %w", f.Name(), err)
+    }
+    if err := os.Rename(f.Name(), f.path); err != nil {
+        return fmt.Errorf("failed to rename %s: %w", f.Name(), err)
+    }
+    f.committed = true
+
+    // the rename itself is only durable once the directory is synced
+    if dir, err := os.Open(filepath.Dir(f.path)); err == nil {
+        if err := dir.Sync(); err != nil {
+            slog.Debug("Failed to sync output directory", "dir", dir.Name(), "error", err)
+        }
+        dir.Close()
+    }
+    return nil
+}
+
+// discard closes and removes the file, also after it was committed.
+func (f *partialFile) discard() {
+    f.Close()
+    if f.direct {
+        return
+    }
+    name := f.Name()
+    if f.committed {
+        name = f.path
+    }
+    if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+        slog.Warn("Failed to remove incomplete output file", "file", name, "error", err)
+    }
+}
+
+// writeFileAtomic writes data to path through a partial file.
+func writeFileAtomic(path string, data []byte) error {
+    file, err := createPartialFile(path)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(data); err != nil {
+        file.discard()
+        return err
+    }
+    if err := file.commit(); err != nil {
+        file.discard()
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartialFile(t *testing.T) {
+    tests := []struct {
+        name       string
+        existing   string // content of the final file before the run, none when empty
+        commit     bool
+        discard    bool // discard after commit or instead of it
+        wantFinal  string
+        wantExists bool
+    }{
+        {"commit", "", true, false, "new", true},
+        {"commit replaces an older file", "old", true, false, "new", true},
+        {"discard", "", false, true, "", false},
+        {"discard keeps an older file", "old", false, true, "old", true},
+        {"discard after commit", "", true, true, "", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            path := filepath.Join(t.TempDir(), "out.zip")
+            if tt.existing != "" {
+                if err := os.WriteFile(path, []byte(tt.existing), 0o644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            file, err := createPartialFile(path)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if _, err := file.Write([]byte("new")); err != nil {
+                t.Fatal(err)
+            }
+            // while written, the data is only under the partial name
+            if data, _ := os.ReadFile(path); string(data) != tt.existing {
+                t.Errorf("final file holds %q while writing, want %q", data, tt.existing)
+            }
+            if _, err := os.Stat(path + partialSuffix); err != nil {
+                t.Errorf("partial file missing while writing: %v", err)
+            }
+
+            if tt.commit {
+                if err := file.commit(); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            if tt.discard {
+                file.discard()
+            }
+
+            data, err := os.ReadFile(path)
+            if exists := err == nil; exists != tt.wantExists || string(data) != tt.wantFinal {
+                t.Errorf("final file = %q (exists %v), want %q (exists %v)", data, exists, tt.wantFinal, tt.wantExists)
+            }
+            if _, err := os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+                t.Errorf("partial file left behind: %v", err)
+            }
+        })
+    }
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "report.json")
+    if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if err := writeFileAtomic(path, []byte(`{"exit_code":0}`)); err != nil {
+        t.Fatal(err)
+    }
+    if data, _ := os.ReadFile(path); string(data) != `{"exit_code":0}` {
+        t.Errorf("file = %q", data)
+    }
+    if _, err := os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+        t.Errorf("partial file left behind: %v", err)
+    }
+
+    if err := writeFileAtomic(filepath.Join(t.TempDir(), "missing", "report.json"), nil); err == nil {
+        t.Error("writing into a missing directory succeeded")
+    }
+}
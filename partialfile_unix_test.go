@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPartialFileDirect(t *testing.T) {
+    // a named pipe is written directly, there is nothing to rename
+    path := filepath.Join(t.TempDir(), "fifo")
+    if err := syscall.Mkfifo(path, 0o644); err != nil {
+        t.Skipf("can't create a named pipe: %v", err)
+    }
+    reader, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer reader.Close()
+
+    file, err := createPartialFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !file.direct {
+        t.Fatal("named pipe not written directly")
+    }
+    if _, err := file.Write([]byte("data")); err != nil {
+        t.Fatal(err)
+    }
+    file.discard()
+    if info, err := os.Stat(path); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+        t.Errorf("named pipe removed or replaced by discard: %v", err)
+    }
+    if _, err := os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+        t.Errorf("partial file created for a named pipe: %v", err)
+    }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+)
+
+// minPoolBuffers is the smallest pool that can't deadlock: the upload holds the first
+// part while the writer fills the second one to decide between a simple and a multipart upload.
+const minPoolBuffers = 2
+
+// partPool is a fixed set of reusable part buffers. Buffers are allocated on demand up to
+// the limit, so memory never exceeds size × bufferSize however slow the upload is, and a
+// small archive doesn't allocate the whole pool.
+type partPool struct {
+    bufferSize int
+    size       int
+    free       chan []byte
+
+    mu        sync.Mutex
+    allocated int
+}
+
+func newPartPool(size, bufferSize int) *partPool {
+    if size < minPoolBuffers {
+        size = minPoolBuffers
+    }
+    return &partPool{
+        bufferSize: bufferSize,
+        size:       size,
+        free:       make(chan []byte, size),
+    }
+}
+
+// get returns an empty buffer, waiting for one to be released once the pool is exhausted.
+// It returns nil when done is closed first.
+func (p *partPool) get(done <-chan struct{}) []byte {
+    select {
+    case buf := <-p.free:
+        return buf[:0]
+    default:
+    }
+
+    p.mu.Lock()
+    if p.allocated < p.size {
+        p.allocated++
+        p.mu.Unlock()
+        return make([]byte, 0, p.bufferSize)
+    }
+    p.mu.Unlock()
+
+    select {
+    case buf := <-p.free:
+        return buf[:0]
+    case <-done:
+        return nil
+    }
+}
+
+// put returns a buffer to the pool. The caller must not use it afterwards.
+func (p *partPool) put(buf []byte) {
+    if cap(buf) < p.bufferSize {
+        return
+    }
+    select {
+    case p.free <- buf:
+    default:
+        // not a buffer of this pool, can't happen
+    }
+}
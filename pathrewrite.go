@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathTransform is a single sed-like substitution, e.g. s|^var/lib/|data/|g
+type PathTransform struct {
+    re     *regexp.Regexp
+    repl   string
+    global bool
+}
+
+// sedBackrefPattern matches sed replacement backreferences: \1..\9 and unescaped &.
+var sedBackrefPattern = regexp.MustCompile(`\\([0-9&\\])|&|\$`)
+
+// ParsePathTransform parses an expression of the form s<d>regex<d>replacement<d>[flags],
+// where <d> is any delimiter character. Supported flags are g (replace all matches) and
+// i (case-insensitive). The regex uses Go's RE2 syntax; the replacement uses sed's \1 and & references.
+func ParsePathTransform(expr string) (*PathTransform, error) {
+    if len(expr) < 4 || expr[0] != 's' {
+        return nil, fmt.Errorf("invalid transform %q, expected s/regex/replacement/[flags]", expr)
+    }
+    delim := expr[1]
+
+    // split on unescaped delimiters; escaped delimiters lose their backslash
+    var fields []string
+    var cur strings.Builder
+    for i := 2; i < len(expr); i++ {
+        c := expr[i]
+        if c == '\\' && i+1 < len(expr) && expr[i+1] == delim {
+            cur.WriteByte(delim)
+            i++
+            continue
+        }
+        if c == '\\' && i+1 < len(expr) {
+            cur.WriteByte(c)
+            cur.WriteByte(expr[i+1])
+            i++
+            continue
+        }
+        if c == delim {
+            fields = append(fields, cur.String())
+            cur.Reset()
+            continue
+        }
+        cur.WriteByte(c)
+    }
+    fields = append(fields, cur.String())
+    if len(fields) != 3 {
+        return nil, fmt.Errorf("invalid transform %q, expected s/regex/replacement/[flags]", expr)
+    }
+
+    pattern, repl, flags := fields[0], fields[1], fields[2]
+    t := &PathTransform{}
+    for _, f := range flags {
+        switch f {
+        case 'g':
+            t.global = true
+        case 'i':
+            pattern = "(?i)" + pattern
+        default:
+            return nil, fmt.Errorf("invalid transform %q, unsupported flag %q", expr, f)
+        }
+    }
+
+    re, err := regexp.Compile(pattern)
+    if err != nil {
+        return nil, fmt.Errorf("invalid transform %q: %v", expr, err)
+    }
+    t.re = re
+
+    // convert sed references into Go's regexp expansion syntax
+    t.repl = sedBackrefPattern.ReplaceAllStringFunc(repl, func(m string) string {
+        switch m {
+        case "&":
+            return "${0}"
+        case "$":
+            return "$$"
+        case `\&`:
+            return "&"
+        case `\\`:
+            return `\`
+        }
+        return "${" + m[1:] + "}"
+    })
+
+    return t, nil
+}
+
+// Apply runs the substitution on a slash-separated archive path.
+func (t *PathTransform) Apply(name string) string {
+    if t.global {
+        return t.re.ReplaceAllString(name, t.repl)
+    }
+    loc := t.re.FindStringSubmatchIndex(name)
+    if loc == nil {
+        return name
+    }
+    var out []byte
+    out = t.re.ExpandString(out, t.repl, name, loc)
+    return name[:loc[0]] + string(out) + name[loc[1]:]
+}
+
+// ParseArchivePrefix checks a -prefix value the same way as rewritten paths: it can't leave
+// the archive root. Leading and trailing slashes are dropped.
+func ParseArchivePrefix(prefix string) (string, error) {
+    for _, elem := range strings.Split(prefix, "/") {
+        if elem == ".." {
+            return "", fmt.Errorf("invalid prefix %q, it leaves the archive root", prefix)
+        }
+    }
+    return strings.Trim(prefix, "/"), nil
+}
+
+// PathRewriter maps the path of an entry to the name stored in the zip:
+// transforms are applied in order, then the prefix is prepended.
+type PathRewriter struct {
+    Prefix     string
+    Transforms []*PathTransform
+}
+
+// Rewrite returns the rewritten name, or "" if the transforms removed the path entirely.
+// Directories are passed with a trailing slash so transforms like s|^a/|data/| match them too;
+// the slash is kept on the result. A result that would escape the archive root is an error.
+func (r *PathRewriter) Rewrite(name string) (string, error) {
+    if r == nil {
+        return name, nil
+    }
+    original := name
+    for _, t := range r.Transforms {
+        name = t.Apply(name)
+    }
+    if r.Prefix == "" && strings.HasPrefix(name, "/") {
+        return "", fmt.Errorf("%s is rewritten to the absolute path %s", original, name)
+    }
+    for _, elem := range strings.Split(name, "/") {
+        if elem == ".." {
+            return "", fmt.Errorf("%s is rewritten to %s, which leaves the archive root", original, name)
+        }
+    }
+
+    isDir := strings.HasSuffix(name, "/")
+    name = strings.Trim(name, "/")
+    if name == "" {
+        return "", nil
+    }
+    if r.Prefix != "" {
+        name = path.Join(r.Prefix, name)
+    }
+    if isDir {
+        name += "/"
+    }
+    return name, nil
+}
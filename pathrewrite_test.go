@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParsePathTransform(t *testing.T) {
+    tests := []struct {
+        expr    string
+        in      string
+        want    string
+        wantErr bool
+    }{
+        {`s|^var/lib/|data/|`, "var/lib/db/x", "data/db/x", false},
+        {`s/a/b/`, "a/a/a", "b/a/a", false},
+        {`s/a/b/g`, "a/a/a", "b/b/b", false},
+        {`s/LOG/logs/i`, "Log/x.log", "logs/x.log", false},
+        {`s/log/LOG/gi`, "log/x.Log", "LOG/x.LOG", false},
+        // RE2 syntax: escaped parentheses are literal, not groups as in sed's BRE
+        {`s,\([0-9]*\)-\([0-9]*\),\2-\1,`, "12-34.txt", "12-34.txt", false},
+        {`s,([0-9]+)-([0-9]+),\2-\1,`, "12-34.txt", "34-12.txt", false},
+        {`s|x|[&]|g`, "xyx", "[x]y[x]", false},
+        {`s|x|\&|`, "x", "&", false},
+        {`s|x|$1|`, "x", "$1", false},
+        {`s|x|a\\b|`, "x", `a\b`, false},
+        // escaped delimiters are taken literally
+        {`s/a\/b/c/`, "a/b/d", "c/d", false},
+        {`s/^tmp\//scratch\//`, "tmp/f", "scratch/f", false},
+        {`s#^#prefix/#`, "f", "prefix/f", false},
+        {`s|x||`, "axb", "ab", false},
+        {"", "", "", true},
+        {"s/a", "", "", true},
+        {"s/a/b", "", "", true},
+        {"s/a/b/c/", "", "", true},
+        {"y/a/b/", "", "", true},
+        {"s/a/b/x", "", "", true},
+        {"s/(/b/", "", "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.expr, func(t *testing.T) {
+            transform, err := ParsePathTransform(tt.expr)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("ParsePathTransform(%q) err = %v, wantErr %v", tt.expr, err, tt.wantErr)
+            }
+            if err != nil {
+                return
+            }
+            if got := transform.Apply(tt.in); got != tt.want {
+                t.Errorf("Apply(%q) = %q, want %q", tt.in, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestPathRewriterRewrite(t *testing.T) {
+    tests := []struct {
+        name       string
+        prefix     string
+        transforms []string
+        in         string
+        want       string
+        wantErr    bool
+    }{
+        {"no rules", "", nil, "a/b.txt", "a/b.txt", false},
+        {"prefix", "backup/2026", nil, "a/b.txt", "backup/2026/a/b.txt", false},
+        {"prefix on a dir", "backup", nil, "a/", "backup/a/", false},
+        {"transform on a dir", "", []string{`s|^a/|data/|`}, "a/", "data/", false},
+        {"transforms in order", "", []string{`s|^a/|b/|`, `s|^b/|c/|`}, "a/x", "c/x", false},
+        {"transform then prefix", "p", []string{`s|\.log$|.txt|`}, "x.log", "p/x.txt", false},
+        {"removed entirely", "", []string{`s|^a/.*||`}, "a/x", "", false},
+        {"dir removed entirely", "p", []string{`s|^a/||`}, "a/", "", false},
+        {"absolute result", "", []string{`s|^|/|`}, "x", "", true},
+        {"absolute result under a prefix", "p", []string{`s|^|/|`}, "x", "p/x", false},
+        {"leaves the root", "", []string{`s|^|../|`}, "x", "", true},
+        {"leaves the root under a prefix", "p", []string{`s|^a/|../../|`}, "a/x", "", true},
+        {"dots in a name", "", []string{`s|^|..x/|`}, "f", "..x/f", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := &PathRewriter{Prefix: tt.prefix}
+            for _, expr := range tt.transforms {
+                transform, err := ParsePathTransform(expr)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                r.Transforms = append(r.Transforms, transform)
+            }
+            got, err := r.Rewrite(tt.in)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Rewrite(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+            }
+            if got != tt.want {
+                t.Errorf("Rewrite(%q) = %q, want %q", tt.in, got, tt.want)
+            }
+        })
+    }
+
+    var nilRewriter *PathRewriter
+    if got, err := nilRewriter.Rewrite("a/b"); err != nil || got != "a/b" {
+        t.Errorf("nil rewriter: Rewrite(a/b) = %q, %v", got, err)
+    }
+}
+
+func TestParseArchivePrefix(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    string
+        wantErr bool
+    }{
+        {"backup-2026-10-17/", "backup-2026-10-17", false},
+        {"/a/b/", "a/b", false},
+        {"a..b", "a..b", false},
+        {"..", "", true},
+        {"../x", "", true},
+        {"a/../..", "", true},
+        {"/a/../../b", "", true},
+    }
+    for _, tt := range tests {
+        got, err := ParseArchivePrefix(tt.in)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("ParseArchivePrefix(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+        }
+        if got != tt.want {
+            t.Errorf("ParseArchivePrefix(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestCreateZipArchiveDuplicateNames(t *testing.T) {
+    root := t.TempDir()
+    writeTree(t, root, map[string]string{"a/x": "1", "b/y": "2"})
+    transform, err := ParsePathTransform(`s|^[ab]/|c/|`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    opts := ArchiveOptions{Rewriter: &PathRewriter{Transforms: []*PathTransform{transform}}, Stats: NewRunStats()}
+
+    // a/ and b/ both become c/, which is only added once
+    var buf bytes.Buffer
+    if err := CreateZipArchive(context.Background(), []ArchiveSource{{Path: root}}, &buf, opts); err != nil {
+        t.Fatalf("merging directories: %v", err)
+    }
+    zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, f := range zr.File {
+        names = append(names, f.Name)
+    }
+    sort.Strings(names)
+    if want := []string{"c/", "c/x", "c/y"}; !reflect.DeepEqual(names, want) {
+        t.Errorf("zip entries = %q, want %q", names, want)
+    }
+
+    // two files rewritten to the same name would be two entries of the same name in the zip
+    writeTree(t, root, map[string]string{"b/x": "3"})
+    err = CreateZipArchive(context.Background(), []ArchiveSource{{Path: root}}, io.Discard, opts)
+    if err == nil || !strings.Contains(err.Error(), "are both stored as c/x") {
+        t.Fatalf("err = %v, want both stored as c/x", err)
+    }
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+    ProgressOff  = "off"
+    ProgressAuto = "auto"
+    ProgressBar  = "bar"
+    ProgressJSON = "json"
+
+    progressBarWidth = 30
+)
+
+// Progress periodically renders the counters of a run as a progress bar on a terminal
+// or as JSON lines. All methods are safe to call on a nil *Progress, which disables reporting.
+type Progress struct {
+    mode     string
+    interval time.Duration
+    out      io.Writer
+    stats    *RunStats
+    start    time.Time
+
+    // values at the previous tick, for the per-interval rates
+    last     progressSnapshot
+    lastTime time.Time
+
+    stop chan struct{}
+    done sync.WaitGroup
+}
+
+type progressSnapshot struct {
+    read, compressed, uploaded int64
+}
+
+// ProgressReport is one JSON progress line.
+type ProgressReport struct {
+    Time            time.Time `json:"time"`
+    ElapsedSeconds  float64   `json:"elapsed_s"`
+    FilesDone       int64     `json:"files_done"`
+    FilesTotal      int64     `json:"files_total,omitempty"`
+    BytesRead       int64     `json:"bytes_read"`
+    BytesTotal      int64     `json:"bytes_total,omitempty"`
+    BytesCompressed int64     `json:"bytes_compressed"`
+    BytesUploaded   int64     `json:"bytes_uploaded"`
+    PartsInFlight   int64     `json:"parts_in_flight"`
+    PartsUploaded   int64     `json:"parts_uploaded"`
+    ReadMiBps       float64   `json:"read_mib_per_s"`
+    CompressMiBps   float64   `json:"compress_mib_per_s"`
+    UploadMiBps     float64   `json:"upload_mib_per_s"`
+    ETASeconds      float64   `json:"eta_s,omitempty"`
+}
+
+// NewProgress returns a reporter for the given mode, or nil when mode is "off".
+// "auto" renders a bar when stderr is a terminal and JSON lines otherwise.
+func NewProgress(mode string, interval time.Duration, stats *RunStats) *Progress {
+    if mode == ProgressOff || mode == "" {
+        return nil
+    }
+    if mode == ProgressAuto {
+        mode = ProgressJSON
+        if isTerminal(os.Stderr) {
+            mode = ProgressBar
+        }
+    }
+    return &Progress{
+        mode:     mode,
+        interval: interval,
+        out:      os.Stderr,
+        stats:    stats,
+    }
+}
+
+// isTerminal reports whether f is a terminal. A character device isn't enough: /dev/null is one too.
+func isTerminal(f *os.File) bool {
+    return term.IsTerminal(int(f.Fd()))
+}
+
+// Start begins rendering until Stop is called.
+func (p *Progress) Start() {
+    if p == nil {
+        return
+    }
+    p.start = time.Now()
+    p.lastTime = p.start
+    p.stop = make(chan struct{})
+    p.done.Add(1)
+    go func() {
+        defer p.done.Done()
+        ticker := time.NewTicker(p.interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                p.render(false)
+            case <-p.stop:
+                p.render(true)
+                return
+            }
+        }
+    }()
+}
+
+// Stop renders a final report and stops the background renderer.
+func (p *Progress) Stop() {
+    if p == nil || p.stop == nil {
+        return
+    }
+    close(p.stop)
+    p.done.Wait()
+    p.stop = nil
+}
+
+// PreScan finds the totals for the ETA. Directories are walked in the background, next to
+// the archive walk, until the walk ends or ctx is cancelled; when every source is a single
+// file or stdin the totals only take a stat and are set right away.
+func (p *Progress) PreScan(ctx context.Context, sources []ArchiveSource, opts ArchiveOptions) {
+    if p == nil {
+        return
+    }
+    filter, err := NewFilterChain(opts.IgnoreFile, opts.Filters)
+    if err != nil {
+        slog.Debug("Skipping the pre-scan, the ETA isn't available", "error", err)
+        return
+    }
+    // the real walk already logs exclusions
+    filter.quiet = true
+
+    scan := func() {
+        var files, bytes int64
+        err := walkSources(sources, filter, func(entry archiveEntry) error {
+            if ctx.Err() != nil {
+                return context.Cause(ctx)
+            }
+            if !entry.Info.IsDir() {
+                files++
+                bytes += entry.Info.Size()
+            }
+            return nil
+        })
+        if err != nil {
+            slog.Debug("Pre-scan stopped, the ETA isn't available", "error", err)
+            return
+        }
+        p.stats.SetTotals(files, bytes)
+    }
+
+    for _, src := range sources {
+        if src.Path == StdinSource {
+            continue
+        }
+        if info, err := os.Stat(src.Path); err == nil && info.IsDir() {
+            go scan()
+            return
+        }
+    }
+    scan()
+}
+
+func (p *Progress) report(now time.Time) ProgressReport {
+    r := ProgressReport{
+        Time:            now,
+        ElapsedSeconds:  now.Sub(p.start).Seconds(),
+        FilesDone:       p.stats.filesAdded.Load(),
+        FilesTotal:      p.stats.totalFiles.Load(),
+        BytesRead:       p.stats.bytesRead.Load(),
+        BytesTotal:      p.stats.totalBytes.Load(),
+        BytesCompressed: p.stats.bytesCompressed.Load(),
+        BytesUploaded:   p.stats.bytesUploaded.Load(),
+        PartsInFlight:   p.stats.partsInFlight.Load(),
+        PartsUploaded:   p.stats.partsUploaded.Load(),
+    }
+
+    if secs := now.Sub(p.lastTime).Seconds(); secs > 0 {
+        r.ReadMiBps = float64(r.BytesRead-p.last.read) / secs / KiB / KiB
+        r.CompressMiBps = float64(r.BytesCompressed-p.last.compressed) / secs / KiB / KiB
+        r.UploadMiBps = float64(r.BytesUploaded-p.last.uploaded) / secs / KiB / KiB
+    }
+    p.last = progressSnapshot{r.BytesRead, r.BytesCompressed, r.BytesUploaded}
+    p.lastTime = now
+
+    // the ETA uses the average read rate, which is much steadier than the per-interval one
+    if r.BytesTotal > 0 && r.BytesRead > 0 && r.ElapsedSeconds > 0 {
+        avg := float64(r.BytesRead) / r.ElapsedSeconds
+        if remaining := r.BytesTotal - r.BytesRead; remaining > 0 {
+            r.ETASeconds = float64(remaining) / avg
+        }
+    }
+    return r
+}
+
+func (p *Progress) render(final bool) {
+    r := p.report(time.Now())
+
+    if p.mode == ProgressJSON {
+        if data, err := json.Marshal(r); err == nil {
+            fmt.Fprintln(p.out, string(data))
+        }
+        return
+    }
+
+    bar := strings.Repeat("-", progressBarWidth)
+    percent := ""
+    if r.BytesTotal > 0 {
+        filled := int(float64(progressBarWidth) * float64(r.BytesRead) / float64(r.BytesTotal))
+        if filled > progressBarWidth {
+            filled = progressBarWidth
+        }
+        bar = strings.Repeat("=", filled) + strings.Repeat("-", progressBarWidth-filled)
+        percent = fmt.Sprintf(" %3.0f%%", 100*float64(r.BytesRead)/float64(r.BytesTotal))
+    }
+    eta := ""
+    if r.ETASeconds > 0 {
+        eta = " ETA " + (time.Duration(r.ETASeconds) * time.Second).String()
+    }
+
+    line := fmt.Sprintf("\r\x1b[2K[%s]%s files %d read %d MiB (%.1f MiB/s) zip %d MiB (%.1f MiB/s) up %d MiB (%.1f MiB/s) parts %d up, %d done%s",
+        bar, percent, r.FilesDone,
+        r.BytesRead/KiB/KiB, r.ReadMiBps,
+        r.BytesCompressed/KiB/KiB, r.CompressMiBps,
+        r.BytesUploaded/KiB/KiB, r.UploadMiBps,
+        r.PartsInFlight, r.PartsUploaded, eta)
+    if final {
+        line += "\n"
+    }
+    fmt.Fprint(p.out, line)
+}
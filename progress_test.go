@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressPreScan(t *testing.T) {
+    root := t.TempDir()
+    writeTree(t, root, map[string]string{"a": "12345", "sub/b": "123", "sub/skip.log": "1234567"})
+    opts := ArchiveOptions{Filters: FilterOptions{Excludes: []string{"*.log"}}}
+
+    waitTotals := func(stats *RunStats) (int64, int64) {
+        for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+            if files := stats.totalFiles.Load(); files > 0 {
+                return files, stats.totalBytes.Load()
+            }
+        }
+        return 0, 0
+    }
+
+    t.Run("directory", func(t *testing.T) {
+        stats := NewRunStats()
+        p := &Progress{stats: stats}
+        p.PreScan(context.Background(), []ArchiveSource{{Path: root}}, opts)
+        if files, bytes := waitTotals(stats); files != 2 || bytes != 8 {
+            t.Errorf("totals = %d files, %d bytes, want 2 files, 8 bytes", files, bytes)
+        }
+    })
+
+    t.Run("single file", func(t *testing.T) {
+        stats := NewRunStats()
+        p := &Progress{stats: stats}
+        p.PreScan(context.Background(), []ArchiveSource{{Path: filepath.Join(root, "a")}}, opts)
+        // set before PreScan returns, without a background walk
+        if files, bytes := stats.totalFiles.Load(), stats.totalBytes.Load(); files != 1 || bytes != 5 {
+            t.Errorf("totals = %d files, %d bytes, want 1 file, 5 bytes", files, bytes)
+        }
+    })
+
+    t.Run("cancelled", func(t *testing.T) {
+        stats := NewRunStats()
+        p := &Progress{stats: stats}
+        ctx, cancel := context.WithCancelCause(context.Background())
+        cancel(errors.New("interrupted"))
+        p.PreScan(ctx, []ArchiveSource{{Path: filepath.Join(root, "a")}}, opts)
+        if files := stats.totalFiles.Load(); files != 0 {
+            t.Errorf("totals set to %d files after the context was cancelled", files)
+        }
+    })
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"t-sync/tracing"
+)
+
+// PutCommand runs t-sync in raw mode: "t-sync put ..." is "t-sync -raw ...".
+const PutCommand = "put"
+
+// CopyRaw copies a single file, named pipe or stdin to writer as is, without zipping it,
+// so it goes through the same part pipeline as an archive.
+func CopyRaw(ctx context.Context, src ArchiveSource, writer io.Writer, opts ArchiveOptions) (err error) {
+    opts.Stats.StageStart("copy")
+    defer opts.Stats.StageEnd("copy")
+
+    ctx, span := tracing.Start(ctx, "copy", tracing.String("source", src.Path))
+    var written int64
+    defer func() {
+        span.SetAttributes(tracing.Int("bytes", written))
+        span.End(err)
+    }()
+
+    var srcFile *os.File
+    if src.Path == StdinSource {
+        srcFile = openStdin()
+    } else {
+        srcFile, err = openFileWithRetry(src.Path)
+        if err != nil {
+            return fmt.Errorf("failed to open %s: %w", src.Path, err)
+        }
+    }
+    if srcFile != os.Stdin {
+        defer srcFile.Close()
+    }
+    defer interruptReads(ctx, srcFile)()
+    slog.Info("Copying source without zipping", "source", src.Path)
+
+    cw := &countingWriter{writer: writer, stats: opts.Stats}
+    written, err = io.Copy(cw, opts.Stats.TrackReads(opts.ReadLimit.LimitReader(ctx, &contextReader{ctx: ctx, reader: srcFile})))
+    if err != nil {
+        return fmt.Errorf("failed to copy %s: %w", src.Path, err)
+    }
+    opts.Stats.FileAdded()
+
+    slog.Info("Source copied", "bytes", written)
+    return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// RunReport is the machine-readable summary of a run, written at exit.
+type RunReport struct {
+    Sources            []string             `json:"sources"`
+    Destination        string               `json:"destination"`
+    Destinations       []string             `json:"destinations,omitempty"` // all of them, when several -d are given
+    StartedAt          time.Time            `json:"started_at"`
+    FinishedAt         time.Time            `json:"finished_at"`
+    DurationSeconds    float64              `json:"duration_s"`
+    StageSeconds       map[string]float64   `json:"stage_s"`
+    ExitCode           int                  `json:"exit_code"`
+    Error              string               `json:"error,omitempty"`
+    Files              int64                `json:"files"`
+    Dirs               int64                `json:"dirs"`
+    Excluded           int64                `json:"excluded"`
+    Skipped            int64                `json:"skipped"`
+    UncompressedBytes  int64                `json:"uncompressed_bytes"`
+    CompressedBytes    int64                `json:"compressed_bytes"`
+    UploadedBytes      int64                `json:"uploaded_bytes"`
+    Parts              int64                `json:"parts"`
+    Retries            int64                `json:"retries"`
+    Objects            []ObjectResult       `json:"objects"`
+    FailedDestinations []DestinationFailure `json:"failed_destinations,omitempty"`
+}
+
+// Reporter writes the run report to -report-file and/or next to the archive.
+type Reporter struct {
+    cfg         *Config
+    destDetails []*DestDetails
+    stats       *RunStats
+    start       time.Time
+}
+
+func NewReporter(cfg *Config, destDetails []*DestDetails, stats *RunStats, start time.Time) *Reporter {
+    return &Reporter{cfg: cfg, destDetails: destDetails, stats: stats, start: start}
+}
+
+// build assembles the report from the run stats.
+func (r *Reporter) build(exitCode int, message string) RunReport {
+    now := time.Now()
+    report := RunReport{
+        Destination:        r.cfg.Destinations[0].String(),
+        StartedAt:          r.start.UTC(),
+        FinishedAt:         now.UTC(),
+        DurationSeconds:    now.Sub(r.start).Seconds(),
+        StageSeconds:       r.stats.StageDurations(),
+        ExitCode:           exitCode,
+        Error:              message,
+        Files:              r.stats.filesAdded.Load(),
+        Dirs:               r.stats.dirsAdded.Load(),
+        Excluded:           r.stats.excluded.Load(),
+        Skipped:            r.stats.skipped.Load(),
+        UncompressedBytes:  r.stats.bytesRead.Load(),
+        CompressedBytes:    r.stats.bytesCompressed.Load(),
+        UploadedBytes:      r.stats.bytesUploaded.Load(),
+        Parts:              r.stats.partsUploaded.Load(),
+        Retries:            r.stats.retries.Load(),
+        Objects:            r.stats.Objects(),
+        FailedDestinations: r.stats.DestinationFailures(),
+    }
+    for _, src := range r.cfg.Sources {
+        report.Sources = append(report.Sources, src.Path)
+    }
+    if len(r.cfg.Destinations) > 1 {
+        for _, dest := range r.cfg.Destinations {
+            report.Destinations = append(report.Destinations, dest.String())
+        }
+    }
+    return report
+}
+
+// Write emits the report for the given exit code. Failures are logged, never fatal,
+// since the report is written on the way out.
+func (r *Reporter) Write(exitCode int, message string) {
+    if r == nil || (r.cfg.ReportFile == "" && !r.cfg.ReportUpload) {
+        return
+    }
+
+    data, err := json.MarshalIndent(r.build(exitCode, message), "", "  ")
+    if err != nil {
+        slog.Error("Failed to encode run report", "error", err)
+        return
+    }
+    data = append(data, '\n')
+
+    switch r.cfg.ReportFile {
+    case "":
+    case "-":
+        os.Stdout.Write(data)
+    default:
+        // through a partial file, so monitoring never reads a half-written report
+        if err := writeFileAtomic(r.cfg.ReportFile, data); err != nil {
+            slog.Error("Failed to write run report", "file", r.cfg.ReportFile, "error", err)
+        }
+    }
+
+    if r.cfg.ReportUpload {
+        // next to the archive in every destination
+        for _, destDetails := range r.destDetails {
+            if destDetails.Provider == "stdout" {
+                continue
+            }
+            details := *destDetails
+            details.Key = reportKey(destDetails.Key)
+            slog.Info("Uploading run report", "key", details.Key)
+            if err := writeSmallObject(context.Background(), &details, r.cfg.AuthType, data); err != nil {
+                slog.Error("Failed to upload run report", "key", details.Key, "error", err)
+            }
+        }
+    }
+}
+
+// reportKey derives the key of the report object: "backups/app.zip" -> "backups/app.report.json".
+func reportKey(key string) string {
+    return strings.TrimSuffix(key, path.Ext(key)) + ".report.json"
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestReporterWrite(t *testing.T) {
+    dir := t.TempDir()
+    reportFile := filepath.Join(dir, "run.json")
+    s3Dest, _ := url.Parse("s3://bucket/backups/app.zip")
+    fileDest, _ := url.Parse("file:///backups/app.zip")
+    cfg := &Config{
+        Sources:      []ArchiveSource{{Path: "/etc/app"}, {Path: "/var/lib/app", Prefix: "data"}},
+        Destinations: []*url.URL{s3Dest, fileDest},
+        ReportFile:   reportFile,
+    }
+
+    stats := NewRunStats()
+    stats.FileAdded()
+    stats.FileAdded()
+    stats.DirAdded()
+    stats.Excluded()
+    stats.StageStart("archive")
+    stats.StageEnd("archive")
+    stats.RecordObject(ObjectResult{Destination: "s3://bucket/backups/app.zip", Key: "backups/app.zip", UploadID: "u1", Parts: 2, ETag: "e", Bytes: 42})
+    stats.RecordDestinationFailure("file:///backups/app.zip", errors.New("disk full"))
+
+    NewReporter(cfg, nil, stats, time.Now().Add(-2*time.Second)).Write(ExitCodeUploadFailed, "upload failed")
+
+    if _, err := os.Stat(reportFile + partialSuffix); !os.IsNotExist(err) {
+        t.Errorf("partial report left behind: %v", err)
+    }
+    data, err := os.ReadFile(reportFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // the keys are the interface monitoring depends on
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(data, &fields); err != nil {
+        t.Fatalf("report isn't a JSON object: %v\n%s", err, data)
+    }
+    var keys []string
+    for key := range fields {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    wantKeys := []string{
+        "compressed_bytes", "destination", "destinations", "dirs", "duration_s", "error", "excluded",
+        "exit_code", "failed_destinations", "files", "finished_at", "objects", "parts", "retries",
+        "skipped", "sources", "stage_s", "started_at", "uncompressed_bytes", "uploaded_bytes",
+    }
+    if !reflect.DeepEqual(keys, wantKeys) {
+        t.Errorf("report keys = %q, want %q", keys, wantKeys)
+    }
+
+    var report RunReport
+    if err := json.Unmarshal(data, &report); err != nil {
+        t.Fatal(err)
+    }
+    if report.ExitCode != ExitCodeUploadFailed || report.Error != "upload failed" {
+        t.Errorf("exit code %d, error %q", report.ExitCode, report.Error)
+    }
+    if report.Files != 2 || report.Dirs != 1 || report.Excluded != 1 {
+        t.Errorf("files %d, dirs %d, excluded %d, want 2, 1, 1", report.Files, report.Dirs, report.Excluded)
+    }
+    if !reflect.DeepEqual(report.Sources, []string{"/etc/app", "/var/lib/app"}) {
+        t.Errorf("sources = %q", report.Sources)
+    }
+    if report.Destination != "s3://bucket/backups/app.zip" || len(report.Destinations) != 2 {
+        t.Errorf("destination %q, destinations %q", report.Destination, report.Destinations)
+    }
+    if report.DurationSeconds < 2 || !report.FinishedAt.After(report.StartedAt) {
+        t.Errorf("duration %v from %v to %v", report.DurationSeconds, report.StartedAt, report.FinishedAt)
+    }
+    if _, ok := report.StageSeconds["archive"]; !ok {
+        t.Errorf("stage_s = %v, want the archive stage", report.StageSeconds)
+    }
+    if len(report.Objects) != 1 || report.Objects[0].Bytes != 42 || report.Objects[0].Parts != 2 {
+        t.Errorf("objects = %+v", report.Objects)
+    }
+    if want := []DestinationFailure{{"file:///backups/app.zip", "disk full"}}; !reflect.DeepEqual(report.FailedDestinations, want) {
+        t.Errorf("failed destinations = %+v, want %+v", report.FailedDestinations, want)
+    }
+}
+
+func TestReporterWriteSuccessOmitsFailures(t *testing.T) {
+    reportFile := filepath.Join(t.TempDir(), "run.json")
+    dest, _ := url.Parse("s3://bucket/app.zip")
+    cfg := &Config{Sources: []ArchiveSource{{Path: "/etc/app"}}, Destinations: []*url.URL{dest}, ReportFile: reportFile}
+
+    NewReporter(cfg, nil, NewRunStats(), time.Now()).Write(0, "")
+
+    data, err := os.ReadFile(reportFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(data, &fields); err != nil {
+        t.Fatal(err)
+    }
+    for _, key := range []string{"error", "destinations", "failed_destinations"} {
+        if _, ok := fields[key]; ok {
+            t.Errorf("%s present in the report of a successful run to one destination", key)
+        }
+    }
+    if string(fields["exit_code"]) != "0" {
+        t.Errorf("exit_code = %s, want 0", fields["exit_code"])
+    }
+}
+
+func TestReportKey(t *testing.T) {
+    tests := map[string]string{
+        "backups/app.zip":       "backups/app.report.json",
+        "app":                   "app.report.json",
+        "dir.d/app.tar.zip":     "dir.d/app.tar.report.json",
+        "backups/2026-10-17.7z": "backups/2026-10-17.report.json",
+    }
+    for key, want := range tests {
+        if got := reportKey(key); got != want {
+            t.Errorf("reportKey(%q) = %q, want %q", key, got, want)
+        }
+    }
+}
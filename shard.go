@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"t-sync/tracing"
+)
+
+const (
+    ShardByDir  = "dir"
+    ShardBySize = "size"
+
+    // top-level files don't belong to any directory, so they get a shard of their own
+    rootShardName = "_root"
+)
+
+// Shard is one independent archive out of a sharded run.
+type Shard struct {
+    Name    string
+    Key     string
+    Entries []archiveEntry
+    Files   int
+    Dirs    int
+    Size    int64 // uncompressed bytes
+}
+
+func (s *Shard) add(entry archiveEntry) {
+    s.Entries = append(s.Entries, entry)
+    if entry.Info.IsDir() {
+        s.Dirs++
+    } else {
+        s.Files++
+        s.Size += entry.Info.Size()
+    }
+}
+
+// ShardIndex is written next to the shards so a restore knows which objects make up the archive.
+// A run that failed after some shards were written leaves a partial index, in which the
+// missing shards carry the error that stopped them.
+type ShardIndex struct {
+    Sources   []string         `json:"sources"`
+    CreatedAt time.Time        `json:"created_at"`
+    ShardBy   string           `json:"shard_by"`
+    Partial   bool             `json:"partial,omitempty"`
+    Shards    []ShardIndexItem `json:"shards"`
+}
+
+type ShardIndexItem struct {
+    Name              string `json:"name"`
+    Key               string `json:"key"`
+    Files             int    `json:"files"`
+    Dirs              int    `json:"dirs"`
+    UncompressedBytes int64  `json:"uncompressed_bytes"`
+    Error             string `json:"error,omitempty"` // set when the shard wasn't written
+}
+
+// shardKey derives the object key (or file path) for a shard: "backups/app.zip" -> "backups/app-<shard>.zip".
+func shardKey(key, shardName string) string {
+    ext := path.Ext(key)
+    return strings.TrimSuffix(key, ext) + "-" + shardName + ext
+}
+
+// shardIndexKey derives the key of the index object: "backups/app.zip" -> "backups/app-index.json".
+func shardIndexKey(key string) string {
+    return strings.TrimSuffix(key, path.Ext(key)) + "-index.json"
+}
+
+// PlanShards walks the sources once and splits the entries into shards.
+//   - dir:  one shard per top-level directory, top-level files go into the "_root" shard.
+//   - size: entries are filled in walk order into shards of roughly shardSize uncompressed bytes.
+func PlanShards(sources []ArchiveSource, opts ArchiveOptions, shardBy string, shardSize int64) ([]*Shard, error) {
+    filter, err := NewFilterChain(opts.IgnoreFile, opts.Filters)
+    if err != nil {
+        return nil, err
+    }
+    filter.OnExclude = func(path string, info os.FileInfo, reason string) {
+        opts.Stats.Excluded()
+    }
+
+    var shards []*Shard
+    byName := make(map[string]*Shard)
+
+    switch shardBy {
+    case ShardByDir:
+        var hasRootFiles, hasRootDir bool
+        err = walkSources(sources, filter, func(entry archiveEntry) error {
+            name := rootShardName
+            top := strings.SplitN(filepath.ToSlash(entry.RelPath), "/", 2)
+            if len(top) > 1 || entry.Info.IsDir() {
+                name = top[0]
+                hasRootDir = hasRootDir || name == rootShardName
+            } else {
+                hasRootFiles = true
+            }
+            if hasRootFiles && hasRootDir {
+                return fmt.Errorf("the top-level directory %s would share its shard with the top-level files, rename it or use -shard-by size", rootShardName)
+            }
+            shard, ok := byName[name]
+            if !ok {
+                shard = &Shard{Name: name}
+                byName[name] = shard
+                shards = append(shards, shard)
+            }
+            shard.add(entry)
+            return nil
+        })
+    case ShardBySize:
+        var current *Shard
+        err = walkSources(sources, filter, func(entry archiveEntry) error {
+            if current == nil || (current.Size > 0 && current.Size+entry.Info.Size() > shardSize) {
+                current = &Shard{Name: fmt.Sprintf("%03d", len(shards))}
+                shards = append(shards, current)
+            }
+            current.add(entry)
+            return nil
+        })
+    default:
+        return nil, fmt.Errorf("unsupported shard-by value: %s", shardBy)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("walk error: %v", err)
+    }
+
+    // keep the directory shards in a stable order regardless of walk order quirks
+    if shardBy == ShardByDir {
+        sort.SliceStable(shards, func(i, j int) bool { return shards[i].Name < shards[j].Name })
+    }
+
+    return shards, nil
+}
+
+// runShardedArchive archives every shard to its own destination, running up to parallelism
+// shards at once, then writes the index. It returns the exit code to use on failure.
+func runShardedArchive(ctx context.Context, cfg *Config, destDetails *DestDetails, stats *RunStats) (int, error) {
+    opts := cfg.ArchiveOptions()
+    opts.Stats = stats
+    stats.StageStart("plan")
+    shards, err := PlanShards(cfg.Sources, opts, cfg.ShardBy, cfg.ShardSize)
+    stats.StageEnd("plan")
+    if err != nil {
+        return ExitCodeZipArchiverFailed, fmt.Errorf("failed to plan shards: %v", err)
+    }
+    if len(shards) == 0 {
+        slog.Warn("Nothing to archive, no shards planned")
+    }
+    slog.Info("Planned shards", "shards", len(shards), "shard_by", cfg.ShardBy)
+
+    // the plan already knows the totals, no pre-scan needed
+    var totalFiles, totalBytes int64
+    for _, shard := range shards {
+        totalFiles += int64(shard.Files)
+        totalBytes += shard.Size
+    }
+    stats.SetTotals(totalFiles, totalBytes)
+
+    type shardResult struct {
+        code int
+        err  error
+    }
+
+    results := make([]shardResult, len(shards))
+    sem := make(chan struct{}, cfg.ShardParallelism)
+    var wg sync.WaitGroup
+
+    // the first failed shard stops the others, which are aborted like on an interrupt
+    shardCtx, cancelShards := context.WithCancelCause(ctx)
+    defer cancelShards(nil)
+    var failMu sync.Mutex
+    failed := -1
+
+    for i, shard := range shards {
+        shard.Key = shardKey(destDetails.Key, shard.Name)
+
+        sem <- struct{}{}
+        if err := context.Cause(shardCtx); err != nil {
+            // don't start the remaining shards
+            <-sem
+            results[i] = shardResult{ExitCodeInterrupted, fmt.Errorf("not started: %v", err)}
+            continue
+        }
+        wg.Add(1)
+        go func(i int, shard *Shard) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            code, err := archiveShard(shardCtx, cfg, destDetails, shard, opts)
+            results[i] = shardResult{code, err}
+            if err != nil {
+                failMu.Lock()
+                if failed < 0 && shardCtx.Err() == nil {
+                    failed = i
+                    cancelShards(fmt.Errorf("shard %s failed", shard.Name))
+                }
+                failMu.Unlock()
+            }
+        }(i, shard)
+    }
+    wg.Wait()
+
+    var code int
+    var runErr error
+    if err := interrupted(ctx); err != nil {
+        code, runErr = ExitCodeInterrupted, fmt.Errorf("%v, uploads aborted", err)
+    } else if failed >= 0 {
+        code, runErr = results[failed].code, fmt.Errorf("shard %s: %v", shards[failed].Name, results[failed].err)
+    }
+
+    index := ShardIndex{
+        CreatedAt: time.Now().UTC(),
+        ShardBy:   cfg.ShardBy,
+        Partial:   runErr != nil,
+    }
+    for _, src := range cfg.Sources {
+        index.Sources = append(index.Sources, src.Path)
+    }
+    written := 0
+    for i, shard := range shards {
+        item := ShardIndexItem{
+            Name:              shard.Name,
+            Key:               shard.Key,
+            Files:             shard.Files,
+            Dirs:              shard.Dirs,
+            UncompressedBytes: shard.Size,
+        }
+        if results[i].err != nil {
+            item.Error = results[i].err.Error()
+        } else {
+            written++
+        }
+        index.Shards = append(index.Shards, item)
+    }
+    if runErr != nil && written == 0 {
+        return code, runErr
+    }
+
+    indexData, err := json.MarshalIndent(index, "", "  ")
+    if err != nil {
+        return ExitCodeInternalCodeError, fmt.Errorf("failed to encode shard index: %v", err)
+    }
+
+    indexDetails := *destDetails
+    indexDetails.Key = shardIndexKey(destDetails.Key)
+    indexCtx := ctx
+    if runErr != nil {
+        // the completed shards stay, so they must be listed even after an interrupt
+        indexCtx = context.WithoutCancel(ctx)
+        slog.Warn("Writing partial shard index", "key", indexDetails.Key, "written_shards", written, "shards", len(shards))
+    } else {
+        slog.Info("Writing shard index", "key", indexDetails.Key)
+    }
+    if err := writeSmallObject(indexCtx, &indexDetails, cfg.AuthType, indexData); err != nil {
+        if runErr != nil {
+            return code, fmt.Errorf("%v, and failed to write the partial shard index: %v", runErr, err)
+        }
+        return ExitCodeUploadFailed, fmt.Errorf("failed to write shard index: %v", err)
+    }
+
+    return code, runErr
+}
+
+// archiveShard streams a single shard to its own destination.
+func archiveShard(ctx context.Context, cfg *Config, destDetails *DestDetails, shard *Shard, opts ArchiveOptions) (code int, err error) {
+    details := *destDetails
+    details.Key = shard.Key
+
+    ctx, span := tracing.Start(ctx, "shard", tracing.String("shard", shard.Name), tracing.String("key", shard.Key))
+    defer func() { span.End(err) }()
+
+    dest, err := OpenDestination(ctx, &details, cfg, opts.Stats)
+    if err != nil {
+        if _, ok := err.(*uploaderClientError); ok {
+            return ExitCodeUploaderClientFailed, fmt.Errorf("failed to create uploader: %v", err)
+        }
+        return ExitCodeInvalidParameters, err
+    }
+
+    archiveErr := CreateZipArchiveFromEntries(ctx, shard.Name, shard.Entries, dest, opts)
+    return finishDestination(ctx, dest, archiveErr)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// shardSummary is what a test checks of a planned shard.
+type shardSummary struct {
+    Name    string
+    Entries []string // archive paths, directories with a trailing slash
+    Files   int
+    Dirs    int
+    Size    int64
+}
+
+func summarizeShards(shards []*Shard) []shardSummary {
+    var out []shardSummary
+    for _, shard := range shards {
+        s := shardSummary{Name: shard.Name, Files: shard.Files, Dirs: shard.Dirs, Size: shard.Size}
+        for _, entry := range shard.Entries {
+            name := filepath.ToSlash(entry.RelPath)
+            if entry.Info.IsDir() {
+                name += "/"
+            }
+            s.Entries = append(s.Entries, name)
+        }
+        out = append(out, s)
+    }
+    return out
+}
+
+func TestPlanShards(t *testing.T) {
+    tests := []struct {
+        name      string
+        files     map[string]string
+        shardBy   string
+        shardSize int64
+        excludes  []string
+        want      []shardSummary
+        wantErr   string
+    }{
+        {
+            name:    "by top-level directory",
+            files:   map[string]string{"b/1": "123", "b/sub/2": "12", "a/3": "1", "top.txt": "1234"},
+            shardBy: ShardByDir,
+            want: []shardSummary{
+                {"_root", []string{"top.txt"}, 1, 0, 4},
+                {"a", []string{"a/", "a/3"}, 1, 1, 1},
+                {"b", []string{"b/", "b/1", "b/sub/", "b/sub/2"}, 2, 2, 5},
+            },
+        },
+        {
+            name:     "excluded paths are left out of the plan",
+            files:    map[string]string{"a/keep": "1", "a/drop.log": "12", "logs/x.log": "1"},
+            shardBy:  ShardByDir,
+            excludes: []string{"*.log", "logs/"},
+            want:     []shardSummary{{"a", []string{"a/", "a/keep"}, 1, 1, 1}},
+        },
+        {
+            name:    "a _root directory without top-level files",
+            files:   map[string]string{"_root/x": "1", "a/y": "1"},
+            shardBy: ShardByDir,
+            want: []shardSummary{
+                {"_root", []string{"_root/", "_root/x"}, 1, 1, 1},
+                {"a", []string{"a/", "a/y"}, 1, 1, 1},
+            },
+        },
+        {
+            name:    "a _root directory clashes with top-level files",
+            files:   map[string]string{"_root/x": "1", "top.txt": "1"},
+            shardBy: ShardByDir,
+            wantErr: "the top-level directory _root would share its shard",
+        },
+        {
+            name:      "by size in walk order",
+            files:     map[string]string{"a": "12345", "b": "12345", "c": "12345", "d": strings.Repeat("x", 20)},
+            shardBy:   ShardBySize,
+            shardSize: 10,
+            want: []shardSummary{
+                {"000", []string{"a", "b"}, 2, 0, 10},
+                {"001", []string{"c"}, 1, 0, 5},
+                // a file larger than the shard size gets a shard of its own
+                {"002", []string{"d"}, 1, 0, 20},
+            },
+        },
+        {
+            name:    "unsupported",
+            files:   map[string]string{"a": "1"},
+            shardBy: "month",
+            wantErr: "unsupported shard-by value",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            root := t.TempDir()
+            writeTree(t, root, tt.files)
+            opts := ArchiveOptions{Filters: FilterOptions{Excludes: tt.excludes}, Stats: NewRunStats()}
+
+            shards, err := PlanShards([]ArchiveSource{{Path: root}}, opts, tt.shardBy, tt.shardSize)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("err = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got := summarizeShards(shards); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("shards = %+v\nwant %+v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestShardKeys(t *testing.T) {
+    tests := []struct {
+        key, shard, wantKey, wantIndex string
+    }{
+        {"backups/app.zip", "_root", "backups/app-_root.zip", "backups/app-index.json"},
+        {"backups/app.zip", "000", "backups/app-000.zip", "backups/app-index.json"},
+        {"app", "logs", "app-logs", "app-index.json"},
+        {"v1.2/app.tar.zip", "a", "v1.2/app.tar-a.zip", "v1.2/app.tar-index.json"},
+    }
+    for _, tt := range tests {
+        if got := shardKey(tt.key, tt.shard); got != tt.wantKey {
+            t.Errorf("shardKey(%q, %q) = %q, want %q", tt.key, tt.shard, got, tt.wantKey)
+        }
+        if got := shardIndexKey(tt.key); got != tt.wantIndex {
+            t.Errorf("shardIndexKey(%q) = %q, want %q", tt.key, got, tt.wantIndex)
+        }
+    }
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptedError is the cancellation cause of the run context after SIGINT or SIGTERM.
+type interruptedError struct {
+    signal os.Signal
+}
+
+func (e *interruptedError) Error() string {
+    return "interrupted by signal: " + e.signal.String()
+}
+
+// withSignals returns a context that is cancelled with an interruptedError on the first
+// SIGINT or SIGTERM, so the walk stops and the upload is aborted. A second signal exits
+// immediately, without cleaning up.
+func withSignals(parent context.Context) (context.Context, func()) {
+    ctx, cancel := context.WithCancelCause(parent)
+    signals := make(chan os.Signal, 2)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+    go func() {
+        select {
+        case sig := <-signals:
+            slog.Warn("Received signal, stopping and aborting the upload. Send it again to exit immediately", "signal", sig.String())
+            cancel(&interruptedError{signal: sig})
+        case <-ctx.Done():
+            return
+        }
+        sig := <-signals
+        slog.Error("Received signal again, exiting without cleanup", "signal", sig.String(), "exit_code", ExitCodeInterrupted)
+        os.Exit(ExitCodeInterrupted)
+    }()
+
+    return ctx, func() {
+        signal.Stop(signals)
+        cancel(nil)
+    }
+}
+
+// interrupted returns the interruptedError if ctx was cancelled by a signal, or nil.
+func interrupted(ctx context.Context) error {
+    var interruptErr *interruptedError
+    if errors.As(context.Cause(ctx), &interruptErr) {
+        return interruptErr
+    }
+    return nil
+}
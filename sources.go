@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StdinSource is the -s value that archives stdin as a single streamed entry.
+const StdinSource = "-"
+
+// DefaultStdinEntryName is the archive path of the stdin entry when -entry-name isn't set.
+const DefaultStdinEntryName = "stdin"
+
+// ArchiveSource is a file or directory on disk and the path it is stored under in the archive.
+type ArchiveSource struct {
+    Path   string
+    Prefix string // archive path of the source root, "" stores directory contents at the archive root
+}
+
+// archivePath maps a path relative to the source root into the archive.
+func (s ArchiveSource) archivePath(relPath string, isDir bool) string {
+    if relPath == "." {
+        if s.Prefix == "" && !isDir {
+            return filepath.Base(s.Path)
+        }
+        return s.Prefix
+    }
+    return filepath.Join(s.Prefix, relPath)
+}
+
+// defaultSourcePrefix mirrors tar: the cleaned path with the leading slash (or volume) stripped.
+func defaultSourcePrefix(path string) string {
+    cleaned := filepath.Clean(path)
+    cleaned = strings.TrimPrefix(cleaned, filepath.VolumeName(cleaned))
+    cleaned = strings.TrimLeft(cleaned, string(filepath.Separator))
+    if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+        // relative paths that climb out of the working directory keep only the last element
+        return filepath.Base(filepath.Clean(path))
+    }
+    return cleaned
+}
+
+// sourceArg is a -s value and the archive prefix given for it with -source-prefix.
+type sourceArg struct {
+    path      string
+    prefix    string
+    hasPrefix bool
+}
+
+// sourceListFlag collects the -s values in the order they were given.
+type sourceListFlag []sourceArg
+
+func (f *sourceListFlag) String() string {
+    paths := make([]string, 0, len(*f))
+    for _, s := range *f {
+        paths = append(paths, s.path)
+    }
+    return strings.Join(paths, ",")
+}
+
+func (f *sourceListFlag) Set(value string) error {
+    *f = append(*f, sourceArg{path: value})
+    return nil
+}
+
+// sourcePrefixFlag sets the archive prefix of the -s given right before it. The prefix is a
+// separate flag so that paths containing '=' (e.g. dt=2026-10-17 partitions) are taken literally.
+type sourcePrefixFlag struct {
+    sources *sourceListFlag
+}
+
+func (f sourcePrefixFlag) String() string {
+    return ""
+}
+
+func (f sourcePrefixFlag) Set(value string) error {
+    if f.sources == nil || len(*f.sources) == 0 {
+        return fmt.Errorf("must follow the -s it applies to")
+    }
+    last := &(*f.sources)[len(*f.sources)-1]
+    if last.hasPrefix {
+        return fmt.Errorf("given twice for %s", last.path)
+    }
+    prefix, err := ParseArchivePrefix(value)
+    if err != nil {
+        return err
+    }
+    last.prefix, last.hasPrefix = prefix, true
+    return nil
+}
+
+// readFilesFrom reads a list of paths, one per line or NUL separated (like tar -T).
+// "-" reads the list from stdin.
+func readFilesFrom(listPath string) ([]string, error) {
+    var data []byte
+    var err error
+    if listPath == "-" {
+        data, err = io.ReadAll(os.Stdin)
+    } else {
+        data, err = os.ReadFile(listPath)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    sep := []byte("\n")
+    if bytes.IndexByte(data, 0) >= 0 {
+        sep = []byte{0}
+    }
+
+    var paths []string
+    for _, line := range bytes.Split(data, sep) {
+        p := strings.TrimRight(string(line), "\r")
+        if p == "" {
+            continue
+        }
+        paths = append(paths, p)
+    }
+    return paths, nil
+}
+
+// ResolveSources turns the -s (and -source-prefix) arguments and the -files-from list into archive sources.
+// A single directory without an explicit prefix keeps the old behaviour of storing its contents
+// at the archive root; everything else defaults to its tar-like path. Stdin ("-") is stored
+// as stdinName.
+func ResolveSources(sourceArgs []sourceArg, filesFrom string, stdinName string) ([]ArchiveSource, error) {
+    var raw []sourceArg
+    readsStdin := false
+    for _, arg := range sourceArgs {
+        if arg.path == StdinSource {
+            if readsStdin {
+                return nil, fmt.Errorf("stdin can only be given once as a source")
+            }
+            readsStdin = true
+            if !arg.hasPrefix {
+                arg.prefix, arg.hasPrefix = stdinName, true
+            }
+        }
+        raw = append(raw, arg)
+    }
+    if readsStdin && filesFrom == StdinSource {
+        return nil, fmt.Errorf("-s - and -files-from - can't both read stdin")
+    }
+    if filesFrom != "" {
+        listed, err := readFilesFrom(filesFrom)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read files-from list: %v", err)
+        }
+        for _, path := range listed {
+            raw = append(raw, sourceArg{path: path})
+        }
+    }
+
+    if len(raw) == 0 {
+        return nil, fmt.Errorf("no sources given")
+    }
+
+    sources := make([]ArchiveSource, 0, len(raw))
+    for _, r := range raw {
+        prefix := r.prefix
+        if !r.hasPrefix && len(raw) > 1 {
+            prefix = defaultSourcePrefix(r.path)
+        }
+        sources = append(sources, ArchiveSource{Path: r.path, Prefix: prefix})
+    }
+    return sources, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSourceFlags(t *testing.T) {
+    tests := []struct {
+        name    string
+        args    []string
+        want    []sourceArg
+        wantErr string
+    }{
+        {"single source", []string{"-s", "/data"}, []sourceArg{{path: "/data"}}, ""},
+        {
+            "equals sign kept literally",
+            []string{"-s", "/lake/dt=2026-10-17"},
+            []sourceArg{{path: "/lake/dt=2026-10-17"}},
+            "",
+        },
+        {
+            "prefix applies to the source before it",
+            []string{"-s", "/a", "-s", "/b", "-source-prefix", "/bee/", "-s", "/c"},
+            []sourceArg{{path: "/a"}, {path: "/b", prefix: "bee", hasPrefix: true}, {path: "/c"}},
+            "",
+        },
+        {
+            "empty prefix stores at the root",
+            []string{"-s", "/a", "-source-prefix", ""},
+            []sourceArg{{path: "/a", hasPrefix: true}},
+            "",
+        },
+        {"prefix before any source", []string{"-source-prefix", "x", "-s", "/a"}, nil, "must follow the -s"},
+        {"prefix leaving the archive root", []string{"-s", "/a", "-source-prefix", "../a"}, nil, "leaves the archive root"},
+        {"prefix given twice", []string{"-s", "/a", "-source-prefix", "x", "-source-prefix", "y"}, nil, "given twice for /a"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var sources sourceListFlag
+            fs := flag.NewFlagSet("t-sync", flag.ContinueOnError)
+            fs.SetOutput(io.Discard)
+            fs.Var(&sources, "s", "")
+            fs.Var(sourcePrefixFlag{&sources}, "source-prefix", "")
+            err := fs.Parse(tt.args)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("err = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual([]sourceArg(sources), tt.want) {
+                t.Errorf("sources = %+v, want %+v", sources, tt.want)
+            }
+        })
+    }
+}
+
+func TestResolveSources(t *testing.T) {
+    list := filepath.Join(t.TempDir(), "list")
+    if err := os.WriteFile(list, []byte("/srv/www\n\nlogs/app\r\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    nulList := filepath.Join(t.TempDir(), "list0")
+    if err := os.WriteFile(nulList, []byte("with\nnewline\x00/etc\x00"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name      string
+        args      []sourceArg
+        filesFrom string
+        want      []ArchiveSource
+        wantErr   bool
+    }{
+        {"single dir at the root", []sourceArg{{path: "/data"}}, "", []ArchiveSource{{"/data", ""}}, false},
+        {
+            "several sources keep their tar-like paths",
+            []sourceArg{{path: "/data/a/"}, {path: "b"}, {path: "../up/c"}, {path: ".."}},
+            "",
+            []ArchiveSource{{"/data/a/", "data/a"}, {"b", "b"}, {"../up/c", "c"}, {"..", ".."}},
+            false,
+        },
+        {
+            "explicit prefixes",
+            []sourceArg{{path: "/a", prefix: "x", hasPrefix: true}, {path: "/b", hasPrefix: true}},
+            "",
+            []ArchiveSource{{"/a", "x"}, {"/b", ""}},
+            false,
+        },
+        {"stdin", []sourceArg{{path: "-"}}, "", []ArchiveSource{{"-", "stdin.log"}}, false},
+        {
+            "stdin with a prefix",
+            []sourceArg{{path: "-", prefix: "in.txt", hasPrefix: true}, {path: "/a"}},
+            "",
+            []ArchiveSource{{"-", "in.txt"}, {"/a", "a"}},
+            false,
+        },
+        {
+            "files-from after -s",
+            []sourceArg{{path: "/a"}},
+            list,
+            []ArchiveSource{{"/a", "a"}, {"/srv/www", "srv/www"}, {"logs/app", "logs/app"}},
+            false,
+        },
+        {"NUL separated list", nil, nulList, []ArchiveSource{{"with\nnewline", "with\nnewline"}, {"/etc", "etc"}}, false},
+        {"no sources", nil, "", nil, true},
+        {"stdin twice", []sourceArg{{path: "-"}, {path: "-"}}, "", nil, true},
+        {"stdin for both", []sourceArg{{path: "-"}}, "-", nil, true},
+        {"missing list", nil, filepath.Join(t.TempDir(), "missing"), nil, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := ResolveSources(tt.args, tt.filesFrom, "stdin.log")
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("sources = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
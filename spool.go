@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// spoolWriteBuffer is the only memory used per part when parts are spooled to disk.
+const spoolWriteBuffer = 1 << 20
+
+// partSpool stores parts in temporary files instead of memory, for uploads of parts
+// too large to buffer. Like the partPool, at most size parts exist at the same time.
+// Every destination spools into its own directory, removed when the upload is done.
+type partSpool struct {
+    dir   string
+    slots chan struct{}
+}
+
+func newPartSpool(parentDir string, size int) (*partSpool, error) {
+    if size < minPoolBuffers {
+        size = minPoolBuffers
+    }
+    dir, err := os.MkdirTemp(parentDir, "t-sync-spool-")
+    if err != nil {
+        return nil, fmt.Errorf("failed to create spool directory: %v", err)
+    }
+    return &partSpool{dir: dir, slots: make(chan struct{}, size)}, nil
+}
+
+// spoolFile is a part being written to the spool.
+type spoolFile struct {
+    file   *os.File
+    writer *bufio.Writer
+    size   int64
+}
+
+// create returns a new empty spool file, waiting while all the parts are in use.
+// It returns nil when done is closed first.
+func (s *partSpool) create(done <-chan struct{}) (*spoolFile, error) {
+    select {
+    case s.slots <- struct{}{}:
+    case <-done:
+        return nil, nil
+    }
+    file, err := os.CreateTemp(s.dir, "part-*")
+    if err != nil {
+        <-s.slots
+        return nil, fmt.Errorf("failed to create spool file: %v", err)
+    }
+    return &spoolFile{file: file, writer: bufio.NewWriterSize(file, spoolWriteBuffer)}, nil
+}
+
+// write appends p to the file, which has no size limit of its own.
+func (f *spoolFile) write(p []byte) error {
+    n, err := f.writer.Write(p)
+    f.size += int64(n)
+    if err != nil {
+        return fmt.Errorf("failed to write spool file: %v", err)
+    }
+    return nil
+}
+
+// finish flushes the file, so the part can be read back.
+func (f *spoolFile) finish() error {
+    if err := f.writer.Flush(); err != nil {
+        return fmt.Errorf("failed to write spool file: %v", err)
+    }
+    return nil
+}
+
+// release deletes the file of a part that was uploaded or given up on.
+func (s *partSpool) release(file *os.File) {
+    file.Close()
+    os.Remove(file.Name())
+    <-s.slots
+}
+
+// remove deletes the spool directory with the parts that were never uploaded, e.g. after
+// an abort. It must only be called once nothing writes or uploads parts.
+func (s *partSpool) remove() error {
+    return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RunStats collects the counters of a run from the walk, the zip writer and the upload
+// workers. It feeds both the live progress and the final report.
+// All methods are safe to call on a nil *RunStats.
+type RunStats struct {
+    // totals from the pre-scan or the shard plan, 0 if unknown
+    totalFiles atomic.Int64
+    totalBytes atomic.Int64
+
+    filesAdded      atomic.Int64
+    dirsAdded       atomic.Int64
+    excluded        atomic.Int64 // ignored or filtered out
+    skipped         atomic.Int64 // duplicates and paths rewritten to nothing
+    bytesRead       atomic.Int64
+    bytesCompressed atomic.Int64
+    bytesUploaded   atomic.Int64
+    partsInFlight   atomic.Int64
+    partsUploaded   atomic.Int64
+    retries         atomic.Int64
+
+    mu                  sync.Mutex
+    stages              map[string]*stageSpan
+    objects             []ObjectResult
+    destinationFailures []DestinationFailure
+
+    partLatency  latencyHistogram
+    partBacklogs []func() int
+}
+
+// partLatencyBuckets are the upper bounds, in seconds, of the part upload latency histogram.
+var partLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// latencyHistogram is a cumulative histogram in the Prometheus sense; guarded by RunStats.mu.
+type latencyHistogram struct {
+    counts []uint64 // one per bucket, non-cumulative
+    count  uint64
+    sum    float64
+}
+
+// stageSpan is the wall clock span of a stage; with shards a stage runs several times
+// and the span goes from the earliest start to the latest end.
+type stageSpan struct {
+    start time.Time
+    end   time.Time
+}
+
+// ObjectResult describes one object (or local file) written by the run.
+type ObjectResult struct {
+    Destination string `json:"destination,omitempty"`
+    Key         string `json:"key"`
+    UploadID    string `json:"upload_id,omitempty"`
+    Parts       int    `json:"parts,omitempty"`
+    ETag        string `json:"etag,omitempty"`
+    VersionID   string `json:"version_id,omitempty"`
+    Bytes       int64  `json:"bytes"`
+}
+
+// DestinationFailure is a destination the archive couldn't be written to, when several
+// were given.
+type DestinationFailure struct {
+    Destination string `json:"destination"`
+    Error       string `json:"error"`
+}
+
+func NewRunStats() *RunStats {
+    return &RunStats{
+        stages:      make(map[string]*stageSpan),
+        partLatency: latencyHistogram{counts: make([]uint64, len(partLatencyBuckets))},
+    }
+}
+
+// SetTotals records the expected number of files and bytes, which enables the ETA.
+func (s *RunStats) SetTotals(files, bytes int64) {
+    if s == nil {
+        return
+    }
+    s.totalFiles.Store(files)
+    s.totalBytes.Store(bytes)
+}
+
+// TrackReads wraps the reader of a source file so its bytes count as read.
+func (s *RunStats) TrackReads(r io.Reader) io.Reader {
+    if s == nil {
+        return r
+    }
+    return &statsReader{r, s}
+}
+
+type statsReader struct {
+    r io.Reader
+    s *RunStats
+}
+
+func (sr *statsReader) Read(b []byte) (int, error) {
+    n, err := sr.r.Read(b)
+    sr.s.bytesRead.Add(int64(n))
+    return n, err
+}
+
+func (s *RunStats) FileAdded() {
+    if s == nil {
+        return
+    }
+    s.filesAdded.Add(1)
+}
+
+func (s *RunStats) DirAdded() {
+    if s == nil {
+        return
+    }
+    s.dirsAdded.Add(1)
+}
+
+func (s *RunStats) Excluded() {
+    if s == nil {
+        return
+    }
+    s.excluded.Add(1)
+}
+
+func (s *RunStats) Skipped() {
+    if s == nil {
+        return
+    }
+    s.skipped.Add(1)
+}
+
+func (s *RunStats) AddCompressed(n int) {
+    if s == nil {
+        return
+    }
+    s.bytesCompressed.Add(int64(n))
+}
+
+func (s *RunStats) PartStarted() {
+    if s == nil {
+        return
+    }
+    s.partsInFlight.Add(1)
+}
+
+// PartFinished marks a part as no longer in flight, counting its bytes if it was uploaded.
+func (s *RunStats) PartFinished(size int, uploaded bool) {
+    if s == nil {
+        return
+    }
+    s.partsInFlight.Add(-1)
+    if uploaded {
+        s.partsUploaded.Add(1)
+        s.bytesUploaded.Add(int64(size))
+    }
+}
+
+func (s *RunStats) Retry() {
+    if s == nil {
+        return
+    }
+    s.retries.Add(1)
+}
+
+func (s *RunStats) StageStart(name string) {
+    if s == nil {
+        return
+    }
+    now := time.Now()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    span, ok := s.stages[name]
+    if !ok {
+        s.stages[name] = &stageSpan{start: now}
+        return
+    }
+    if now.Before(span.start) {
+        span.start = now
+    }
+}
+
+func (s *RunStats) StageEnd(name string) {
+    if s == nil {
+        return
+    }
+    now := time.Now()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if span, ok := s.stages[name]; ok && now.After(span.end) {
+        span.end = now
+    }
+}
+
+// StageDurations returns the seconds spent in each finished stage.
+func (s *RunStats) StageDurations() map[string]float64 {
+    if s == nil {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    durations := make(map[string]float64, len(s.stages))
+    for name, span := range s.stages {
+        if !span.end.IsZero() {
+            durations[name] = span.end.Sub(span.start).Seconds()
+        }
+    }
+    return durations
+}
+
+// RecordObject remembers an object written by the run, for the report.
+func (s *RunStats) RecordObject(obj ObjectResult) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.objects = append(s.objects, obj)
+}
+
+func (s *RunStats) Objects() []ObjectResult {
+    if s == nil {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]ObjectResult(nil), s.objects...)
+}
+
+// RecordDestinationFailure remembers a destination that failed, for the report.
+func (s *RunStats) RecordDestinationFailure(destination string, err error) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.destinationFailures = append(s.destinationFailures, DestinationFailure{Destination: destination, Error: err.Error()})
+}
+
+func (s *RunStats) DestinationFailures() []DestinationFailure {
+    if s == nil {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]DestinationFailure(nil), s.destinationFailures...)
+}
+
+// ObservePartLatency records how long a single part upload took, including retries.
+func (s *RunStats) ObservePartLatency(d time.Duration) {
+    if s == nil {
+        return
+    }
+    secs := d.Seconds()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i, bound := range partLatencyBuckets {
+        if secs <= bound {
+            s.partLatency.counts[i]++
+            break
+        }
+    }
+    s.partLatency.count++
+    s.partLatency.sum += secs
+}
+
+// TrackPartBacklog registers a part channel whose queued parts count as backlog.
+func (s *RunStats) TrackPartBacklog(backlog func() int) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.partBacklogs = append(s.partBacklogs, backlog)
+}
+
+// PartBacklog is the number of parts waiting in part channels for an upload worker.
+func (s *RunStats) PartBacklog() int {
+    if s == nil {
+        return 0
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    total := 0
+    for _, backlog := range s.partBacklogs {
+        total += backlog()
+    }
+    return total
+}
@@ -0,0 +1,49 @@
+package storage_clients
+
+import (
+	"context"
+	"io"
+
+	"t-sync/tracing"
+)
+
+type retryHookKey struct{}
+
+// RetryHook is called every time an operation is about to be retried.
+type RetryHook func(op string, attempt int, err error)
+
+// WithRetryHook returns a context that makes the uploaders report their retries to hook.
+func WithRetryHook(ctx context.Context, hook RetryHook) context.Context {
+	return context.WithValue(ctx, retryHookKey{}, hook)
+}
+
+// notifyRetry reports a retry to the hook in ctx, if any.
+func notifyRetry(ctx context.Context, op string, attempt int, err error) {
+	if hook, ok := ctx.Value(retryHookKey{}).(RetryHook); ok {
+		hook(op, attempt, err)
+	}
+}
+
+type bodyWrapperKey struct{}
+
+// BodyWrapper wraps the body of an object read from storage, e.g. to limit its bandwidth.
+type BodyWrapper func(ctx context.Context, body io.Reader) io.Reader
+
+// WithBodyWrapper returns a context that makes ranged reads pass every response body,
+// retried attempts included, through wrap.
+func WithBodyWrapper(ctx context.Context, wrap BodyWrapper) context.Context {
+	return context.WithValue(ctx, bodyWrapperKey{}, wrap)
+}
+
+// wrapBody applies the BodyWrapper in ctx to body, if any.
+func wrapBody(ctx context.Context, body io.Reader) io.Reader {
+	if wrap, ok := ctx.Value(bodyWrapperKey{}).(BodyWrapper); ok {
+		return wrap(ctx, body)
+	}
+	return body
+}
+
+// startAttempt starts a span for a single attempt of an SDK call.
+func startAttempt(ctx context.Context, name string, attempt int) (context.Context, *tracing.Span) {
+	return tracing.Start(ctx, name, tracing.Int("attempt", int64(attempt)))
+}
@@ -0,0 +1,12 @@
+package storage_clients
+
+import (
+	"time"
+)
+
+// MultipartUpload is an in-progress multipart upload of a bucket.
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
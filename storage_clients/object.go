@@ -0,0 +1,8 @@
+package storage_clients
+
+// ObjectStat is the size and ETag of a stored object. Ranged reads pass the ETag along,
+// so all the ranges of a download come from the same version of the object.
+type ObjectStat struct {
+	Size int64
+	ETag string
+}
@@ -7,13 +7,15 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/oracle/oci-go-sdk/v65/common"
 	"github.com/oracle/oci-go-sdk/v65/common/auth"
 	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+
+	"t-sync/tracing"
 )
 
 func init() {
@@ -28,6 +30,11 @@ type OCIUploader struct {
 	namespace string
 	bucket    string
 	object    string
+	logger    *slog.Logger
+
+	// ETag and version of the object once Complete or PutObject succeeded
+	etag      string
+	versionID string
 }
 
 // NewOCIUploader creates a new OCIUploader.
@@ -39,9 +46,6 @@ func NewOCIUploader(namespace, bucket, object, authType string) (*OCIUploader, e
 	if bucket == "" {
 		return nil, fmt.Errorf("bucket is required")
 	}
-	if object == "" {
-		return nil, fmt.Errorf("object name is required")
-	}
 
 	var provider common.ConfigurationProvider
 	var err error
@@ -56,25 +60,25 @@ func NewOCIUploader(namespace, bucket, object, authType string) (*OCIUploader, e
 				profile = authType[start+1 : end]
 			}
 		}
-		log.Printf("Using OCI config file with profile: %s", profile)
+		slog.Info("Using OCI config file", "provider", "oci", "profile", profile)
 		provider = common.CustomProfileConfigProvider("~/.oci/config", profile)
 	} else if authType == "OKE_WORKLOAD_IDENTITY" {
 		// Handle OKE Workload Identity
-		log.Printf("Using OKE Workload Identity authentication")
+		slog.Info("Using OKE Workload Identity authentication", "provider", "oci")
 		provider, err = auth.OkeWorkloadIdentityConfigurationProvider()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create OKE workload identity provider: %v", err)
 		}
 	} else if authType == "INSTANCE_PRINCIPAL" {
 		// Handle Instance Principal
-		log.Printf("Using Instance Principal authentication")
+		slog.Info("Using Instance Principal authentication", "provider", "oci")
 		provider, err = auth.InstancePrincipalConfigurationProvider()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create instance principal provider: %v", err)
 		}
 	} else {
 		// Default to config file provider
-		log.Printf("Using default OCI config file authentication")
+		slog.Info("Using default OCI config file authentication", "provider", "oci")
 		provider = common.DefaultConfigProvider()
 	}
 
@@ -82,19 +86,25 @@ func NewOCIUploader(namespace, bucket, object, authType string) (*OCIUploader, e
 	if err != nil {
 		return nil, fmt.Errorf("failed to create OCI object storage client: %v", err)
 	}
+	client.HTTPClient = tracing.WrapClient(client.HTTPClient)
+	// retries are done by retry(), see NewS3Uploader
+	noRetry := common.NoRetryPolicy()
+	client.SetCustomClientConfiguration(common.CustomClientConfiguration{RetryPolicy: &noRetry})
 
-	log.Printf("OCI client created successfully for namespace: %s, bucket: %s, object: %s", namespace, bucket, object)
+	logger := slog.With("provider", "oci", "namespace", namespace, "bucket", bucket, "object", object)
+	logger.Info("OCI client created successfully")
 
 	return &OCIUploader{
 		client:    client,
 		namespace: namespace,
 		bucket:    bucket,
 		object:    object,
+		logger:    logger,
 	}, nil
 }
 
 func (u *OCIUploader) Initiate(ctx context.Context) (string, error) {
-	log.Printf("Initiating multipart upload for namespace: %s, bucket: %s, object: %s", u.namespace, u.bucket, u.object)
+	u.logger.Info("Initiating multipart upload")
 
 	req := objectstorage.CreateMultipartUploadRequest{
 		NamespaceName: &u.namespace,
@@ -104,79 +114,68 @@ func (u *OCIUploader) Initiate(ctx context.Context) (string, error) {
 		},
 	}
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
+	var uploadID string
+	err := retry(ctx, u.operation("oci.CreateMultipartUpload", "initiate", "initiate multipart upload", u.logger), func(ctx context.Context) error {
 		resp, err := u.client.CreateMultipartUpload(ctx, req)
-		if err == nil {
-			uploadID := *resp.UploadId
-			log.Printf("Successfully initiated multipart upload with ID: %s", uploadID)
-			return uploadID, nil
-		}
-
-		lastErr = err
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed to initiate multipart upload: %v. Retrying in %v...", attempt, lastErr, backoff)
-
-			select {
-			case <-ctx.Done():
-				return "", fmt.Errorf("context cancelled while waiting to retry initiate: %v", ctx.Err())
-			case <-time.After(backoff):
-				// retry
-			}
+		if err != nil {
+			return err
 		}
+		uploadID = stringValue(resp.UploadId)
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
-
-	return "", fmt.Errorf("failed to initiate multipart upload after 3 attempts: %v", lastErr)
+	u.logger.Info("Successfully initiated multipart upload", "upload_id", uploadID)
+	return uploadID, nil
 }
 
 func (u *OCIUploader) UploadPart(ctx context.Context, uploadID string, partNumber int, data []byte) (string, error) {
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
+	return u.UploadPartFrom(ctx, uploadID, partNumber, bytes.NewReader(data), int64(len(data)))
+}
+
+// UploadPartFrom uploads a part of size bytes read from body, which is read again from
+// the start when an attempt is retried.
+func (u *OCIUploader) UploadPartFrom(ctx context.Context, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	logger := u.logger.With("upload_id", uploadID, "part", partNumber)
+
+	var etag string
+	err := retry(ctx, u.operation("oci.UploadPart", "upload_part", fmt.Sprintf("upload part %d", partNumber), logger), func(ctx context.Context) error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind part %d: %v", partNumber, err)
+		}
 		req := objectstorage.UploadPartRequest{
 			NamespaceName:  &u.namespace,
 			BucketName:     &u.bucket,
 			ObjectName:     &u.object,
 			UploadId:       &uploadID,
 			UploadPartNum:  &partNumber,
-			ContentLength:  common.Int64(int64(len(data))),
-			UploadPartBody: io.NopCloser(bytes.NewReader(data)),
+			ContentLength:  common.Int64(size),
+			UploadPartBody: io.NopCloser(body),
 		}
-
 		resp, err := u.client.UploadPart(ctx, req)
 		req.UploadPartBody = nil
-		if err == nil {
-			// Return the ETag from the response
-			if resp.ETag != nil {
-				// Copy the string to decouple from potential SDK response buffers
-				etag := string([]byte(*resp.ETag))
-				log.Printf("Successfully uploaded part %d with ETag: %s, %d bytes", partNumber, etag, len(data))
-				return etag, nil
-			}
-			lastErr = fmt.Errorf("no ETag returned for part %d", partNumber)
-			// Fall through to retry logic, as this is unexpected
-		} else {
-			lastErr = err
+		if err != nil {
+			return err
 		}
-
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second // 1s, 2s, 4s
-			log.Printf("Attempt %d failed for part %d: %v. Retrying in %v...", attempt, partNumber, lastErr, backoff)
-			
-			select {
-			case <-ctx.Done():
-				return "", fmt.Errorf("context cancelled while waiting to retry upload part %d: %v", partNumber, ctx.Err())
-			case <-time.After(backoff):
-				// retry
-			}
+		if resp.ETag == nil {
+			// unexpected, retried like a server error
+			return fmt.Errorf("no ETag returned for part %d", partNumber)
 		}
+		// Copy the string to decouple from potential SDK response buffers
+		etag = string([]byte(*resp.ETag))
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
 
-	return "", fmt.Errorf("failed to upload part %d after 3 attempts: %v", partNumber, lastErr)
+	logger.Debug("Successfully uploaded part", "etag", etag, "bytes", size)
+	return etag, nil
 }
 
 func (u *OCIUploader) Complete(ctx context.Context, uploadID string, etags map[int]string) error {
-	log.Printf("Completing multipart upload %s with %d parts", uploadID, len(etags))
+	u.logger.Info("Completing multipart upload", "upload_id", uploadID, "parts", len(etags))
 
 	parts := make([]objectstorage.CommitMultipartUploadPartDetails, 0, len(etags))
 	for partNum, etag := range etags {
@@ -196,113 +195,140 @@ func (u *OCIUploader) Complete(ctx context.Context, uploadID string, etags map[i
 		},
 	}
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
-		_, err := u.client.CommitMultipartUpload(ctx, req)
-		if err == nil {
-			log.Printf("Successfully completed multipart upload %s", uploadID)
-			return nil
-		}
-
-		lastErr = err
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed to complete multipart upload %s: %v. Retrying in %v...", attempt, uploadID, lastErr, backoff)
-
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("context cancelled while waiting to retry complete: %v", ctx.Err())
-			case <-time.After(backoff):
-				// retry
-			}
+	logger := u.logger.With("upload_id", uploadID)
+	err := retry(ctx, u.operation("oci.CommitMultipartUpload", "complete", "complete multipart upload", logger), func(ctx context.Context) error {
+		resp, err := u.client.CommitMultipartUpload(ctx, req)
+		if err != nil {
+			return err
 		}
+		u.etag, u.versionID = stringValue(resp.ETag), stringValue(resp.VersionId)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-
-	return fmt.Errorf("failed to complete multipart upload after 3 attempts: %v", lastErr)
+	logger.Info("Successfully completed multipart upload")
+	return nil
 }
 
 func (u *OCIUploader) PutObject(ctx context.Context, data []byte) error {
-	log.Printf("Putting object %s with %d bytes (simple upload)", u.object, len(data))
+	return u.PutObjectFrom(ctx, bytes.NewReader(data), int64(len(data)))
+}
+
+// PutObjectFrom uploads the object in a single request from size bytes read from body,
+// which is read again from the start when an attempt is retried.
+func (u *OCIUploader) PutObjectFrom(ctx context.Context, body io.ReadSeeker, size int64) error {
+	u.logger.Info("Putting object (simple upload)", "bytes", size)
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
+	err := retry(ctx, u.operation("oci.PutObject", "put_object", "put object", u.logger), func(ctx context.Context) error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind object: %v", err)
+		}
 		req := objectstorage.PutObjectRequest{
 			NamespaceName: &u.namespace,
 			BucketName:    &u.bucket,
 			ObjectName:    &u.object,
-			ContentLength: common.Int64(int64(len(data))),
-			// Re-create the reader for each attempt in case the payload was partially read
-			PutObjectBody: io.NopCloser(bytes.NewReader(data)),
+			ContentLength: common.Int64(size),
+			// body was rewound above in case a previous attempt partially read it
+			PutObjectBody: io.NopCloser(body),
 		}
-
-		_, err := u.client.PutObject(ctx, req)
+		resp, err := u.client.PutObject(ctx, req)
 		req.PutObjectBody = nil
-		if err == nil {
-			log.Printf("Successfully put object %s", u.object)
-			return nil
-		}
-
-		lastErr = err
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed to put object %s: %v. Retrying in %v...", attempt, u.object, lastErr, backoff)
-
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("context cancelled while waiting to retry put object: %v", ctx.Err())
-			case <-time.After(backoff):
-				// retry
-			}
+		if err != nil {
+			return err
 		}
+		u.etag, u.versionID = stringValue(resp.ETag), stringValue(resp.VersionId)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-
-	return fmt.Errorf("failed to put object after 3 attempts: %v", lastErr)
+	u.logger.Info("Successfully put object")
+	return nil
 }
 
 func (u *OCIUploader) Abort(ctx context.Context, uploadID string) error {
-	log.Printf("Aborting multipart upload %s", uploadID)
+	return u.abortUpload(ctx, u.object, uploadID)
+}
+
+// AbortMultipartUpload aborts an upload of any object in the bucket.
+func (u *OCIUploader) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	return u.abortUpload(ctx, key, uploadID)
+}
+
+func (u *OCIUploader) abortUpload(ctx context.Context, key, uploadID string) error {
+	logger := u.logger.With("key", key, "upload_id", uploadID)
+	logger.Info("Aborting multipart upload")
 
 	req := objectstorage.AbortMultipartUploadRequest{
 		NamespaceName: &u.namespace,
 		BucketName:    &u.bucket,
-		ObjectName:    &u.object,
+		ObjectName:    &key,
 		UploadId:      &uploadID,
 	}
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
+	err := retry(ctx, u.operation("oci.AbortMultipartUpload", "abort", "abort multipart upload", logger), func(ctx context.Context) error {
 		_, err := u.client.AbortMultipartUpload(ctx, req)
-		if err == nil {
-			log.Printf("Successfully aborted multipart upload %s", uploadID)
-			return nil
-		}
-
-		// If the upload does not exist, it was likely already aborted or completed successfully
-		if strings.Contains(err.Error(), "NoSuchUpload") || strings.Contains(err.Error(), "404") {
-			log.Printf("Multipart upload %s already aborted or not found", uploadID)
+		if err != nil && classifyOCIError(err) == ErrorClassNotFound {
+			// If the upload does not exist, it was likely already aborted or completed successfully
+			logger.Info("Multipart upload already aborted or not found")
 			return nil
 		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Successfully aborted multipart upload")
+	return nil
+}
 
-		lastErr = err
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed to abort multipart upload %s: %v. Retrying in %v...", attempt, uploadID, lastErr, backoff)
+func (u *OCIUploader) operation(span, hook, what string, logger *slog.Logger) operation {
+	return operation{span: span, hook: hook, what: what, logger: logger, classify: classifyOCIError}
+}
 
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("context cancelled while waiting to retry abort: %v", ctx.Err())
-			case <-time.After(backoff):
-				// retry
-			}
+// classifyOCIError classifies OCI errors by their HTTP status, see
+// https://docs.oracle.com/iaas/Content/API/References/apierrors.htm
+func classifyOCIError(err error) ErrorClass {
+	if class := classifyCommon(err); class == ErrorClassCanceled {
+		return class
+	}
+	if serviceErr, ok := common.IsServiceError(err); ok {
+		if serviceErr.GetCode() == "NotAuthenticated" {
+			return ErrorClassAuth
 		}
+		return classifyStatus(serviceErr.GetHTTPStatusCode())
+	}
+	if common.IsNetworkError(err) {
+		return ErrorClassNetwork
 	}
+	return classifyCommon(err)
+}
 
-	return fmt.Errorf("failed to abort multipart upload after 3 attempts: %v", lastErr)
+// StatObject returns the size and ETag of the object.
+func (u *OCIUploader) StatObject(ctx context.Context) (ObjectStat, error) {
+	var stat ObjectStat
+	err := retry(ctx, u.operation("oci.HeadObject", "head_object", "get object info", u.logger), func(ctx context.Context) error {
+		resp, err := u.client.HeadObject(ctx, objectstorage.HeadObjectRequest{
+			NamespaceName: &u.namespace,
+			BucketName:    &u.bucket,
+			ObjectName:    &u.object,
+		})
+		if err != nil {
+			return err
+		}
+		stat = ObjectStat{ETag: stringValue(resp.ETag)}
+		if resp.ContentLength != nil {
+			stat.Size = *resp.ContentLength
+		}
+		return nil
+	})
+	return stat, err
 }
 
-// GetObjectRange retrieves a specific byte range from an object in OCI Object Storage
-// This can be used to emulate seek operations by reading specific parts of an object
-func (u *OCIUploader) GetObjectRange(ctx context.Context, startByte, endByte int64) ([]byte, error) {
+// GetObjectRange retrieves the bytes from startByte to endByte, inclusive, of the object.
+// With a non-empty ifMatch the read fails unless the object still has that ETag.
+func (u *OCIUploader) GetObjectRange(ctx context.Context, startByte, endByte int64, ifMatch string) ([]byte, error) {
 	if startByte < 0 {
 		return nil, fmt.Errorf("start byte must be non-negative")
 	}
@@ -311,26 +337,110 @@ func (u *OCIUploader) GetObjectRange(ctx context.Context, startByte, endByte int
 	}
 
 	rangeHeader := fmt.Sprintf("bytes=%d-%d", startByte, endByte)
-	log.Printf("Getting object range: %s for object %s", rangeHeader, u.object)
+	logger := u.logger.With("range", rangeHeader)
+	logger.Debug("Getting object range")
 
-	req := objectstorage.GetObjectRequest{
+	var data []byte
+	err := retry(ctx, u.operation("oci.GetObject", "get_object", fmt.Sprintf("get object range %s", rangeHeader), logger), func(ctx context.Context) error {
+		req := objectstorage.GetObjectRequest{
+			NamespaceName: &u.namespace,
+			BucketName:    &u.bucket,
+			ObjectName:    &u.object,
+			Range:         &rangeHeader,
+		}
+		if ifMatch != "" {
+			req.IfMatch = &ifMatch
+		}
+		resp, err := u.client.GetObject(ctx, req)
+		if err != nil {
+			return err
+		}
+		defer resp.Content.Close()
+
+		// A connection dropped mid-body fails the attempt, so the range is read again
+		data, err = io.ReadAll(wrapBody(ctx, resp.Content))
+		if err != nil {
+			return fmt.Errorf("failed to read object content: %w", err)
+		}
+		if int64(len(data)) != endByte-startByte+1 {
+			return fmt.Errorf("short read of range %s: got %d bytes: %w", rangeHeader, len(data), io.ErrUnexpectedEOF)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("Successfully retrieved object range", "bytes", len(data))
+	return data, nil
+}
+
+// ListMultipartUploads lists the in-progress multipart uploads of the bucket whose object
+// name starts with prefix. OCI can't filter by prefix, so all uploads are listed.
+func (u *OCIUploader) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	req := objectstorage.ListMultipartUploadsRequest{
 		NamespaceName: &u.namespace,
 		BucketName:    &u.bucket,
-		ObjectName:    &u.object,
-		Range:         &rangeHeader,
 	}
 
-	resp, err := u.client.GetObject(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get object range: %v", err)
+	var uploads []MultipartUpload
+	for {
+		var resp objectstorage.ListMultipartUploadsResponse
+		err := retry(ctx, u.operation("oci.ListMultipartUploads", "list_uploads", "list multipart uploads", u.logger), func(ctx context.Context) error {
+			var err error
+			resp, err = u.client.ListMultipartUploads(ctx, req)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list multipart uploads: %v", err)
+		}
+		for _, upload := range resp.Items {
+			object := stringValue(upload.Object)
+			if !strings.HasPrefix(object, prefix) {
+				continue
+			}
+			var initiated time.Time
+			if upload.TimeCreated != nil {
+				initiated = upload.TimeCreated.Time
+			}
+			uploads = append(uploads, MultipartUpload{
+				Key:       object,
+				UploadID:  stringValue(upload.UploadId),
+				Initiated: initiated,
+			})
+		}
+		if resp.OpcNextPage == nil {
+			return uploads, nil
+		}
+		req.Page = resp.OpcNextPage
 	}
-	defer resp.Content.Close()
+}
 
-	data, err := io.ReadAll(resp.Content)
+// CheckAccess makes a lightweight HeadBucket call to validate credentials and bucket access
+// without creating anything.
+func (u *OCIUploader) CheckAccess(ctx context.Context) error {
+	u.logger.Info("Checking access to bucket")
+	err := retry(ctx, u.operation("oci.HeadBucket", "head_bucket", "check bucket access", u.logger), func(ctx context.Context) error {
+		_, err := u.client.HeadBucket(ctx, objectstorage.HeadBucketRequest{
+			NamespaceName: &u.namespace,
+			BucketName:    &u.bucket,
+		})
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read object content: %v", err)
+		return fmt.Errorf("failed to access bucket %s: %v", u.bucket, err)
 	}
+	return nil
+}
 
-	log.Printf("Successfully retrieved %d bytes from object range", len(data))
-	return data, nil
+// ObjectInfo returns the ETag and version ID of the object written by Complete or PutObject.
+func (u *OCIUploader) ObjectInfo() (etag string, versionID string) {
+	return u.etag, u.versionID
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
 }
@@ -0,0 +1,191 @@
+package storage_clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how the uploaders retry failed storage calls. Delays use full
+// jitter: attempt n waits a random time between 0 and min(MaxDelay, BaseDelay*2^(n-1)).
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Deadline is the time after which no new attempt of a call is started, 0 for none.
+	Deadline time.Duration
+}
+
+// DefaultRetryPolicy matches the attempts and delays the uploaders always used.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+var (
+	retryPolicyMu sync.RWMutex
+	retryPolicy   = DefaultRetryPolicy
+)
+
+// SetRetryPolicy sets the retry policy used by all uploaders.
+func SetRetryPolicy(policy RetryPolicy) {
+	retryPolicyMu.Lock()
+	defer retryPolicyMu.Unlock()
+	retryPolicy = policy
+}
+
+func currentRetryPolicy() RetryPolicy {
+	retryPolicyMu.RLock()
+	defer retryPolicyMu.RUnlock()
+	return retryPolicy
+}
+
+// backoff returns the jittered delay before retrying after the given attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay << uint(attempt-1)
+	if ceiling <= 0 || ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// ErrorClass is the kind of a failed storage call, which decides whether it is retried.
+type ErrorClass string
+
+const (
+	ErrorClassThrottling ErrorClass = "throttling"
+	ErrorClassServer     ErrorClass = "server"
+	ErrorClassNetwork    ErrorClass = "network"
+	ErrorClassAuth       ErrorClass = "auth"
+	ErrorClassNotFound   ErrorClass = "not_found"
+	ErrorClassClient     ErrorClass = "client"
+	ErrorClassCanceled   ErrorClass = "canceled"
+	ErrorClassUnknown    ErrorClass = "unknown"
+)
+
+// Retryable reports whether a call that failed with this class of error may succeed when retried.
+func (c ErrorClass) Retryable() bool {
+	switch c {
+	case ErrorClassThrottling, ErrorClassServer, ErrorClassNetwork, ErrorClassUnknown:
+		return true
+	}
+	return false
+}
+
+// classifyStatus classifies an HTTP status code returned by a storage service.
+func classifyStatus(status int) ErrorClass {
+	switch {
+	case status == 429 || status == 503:
+		return ErrorClassThrottling
+	case status >= 500:
+		return ErrorClassServer
+	case status == 401 || status == 403:
+		return ErrorClassAuth
+	case status == 404:
+		return ErrorClassNotFound
+	case status == 408:
+		return ErrorClassNetwork
+	case status >= 400:
+		return ErrorClassClient
+	}
+	return ErrorClassUnknown
+}
+
+// classifyCommon classifies errors that don't depend on the provider: cancellation and
+// network failures.
+func classifyCommon(err error) ErrorClass {
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassCanceled
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassNetwork
+	}
+	return ErrorClassUnknown
+}
+
+// RetryError is returned when a storage call failed for good, either because the error
+// isn't retryable or because the attempts or the deadline ran out.
+type RetryError struct {
+	Op       string
+	Attempts int
+	Class    ErrorClass
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	if !e.Class.Retryable() {
+		return fmt.Sprintf("failed to %s (%s error, not retried): %v", e.Op, e.Class, e.Err)
+	}
+	return fmt.Sprintf("failed to %s after %d attempts: %v", e.Op, e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// operation describes a storage call for retries, logs and traces.
+type operation struct {
+	span     string // SDK operation, e.g. "s3.UploadPart"
+	hook     string // op reported to the RetryHook, e.g. "upload_part"
+	what     string // for messages, e.g. "upload part 3"
+	logger   *slog.Logger
+	classify func(error) ErrorClass
+}
+
+// retry runs fn under the current retry policy until it succeeds, fails with an error
+// that isn't retryable, or runs out of attempts or time.
+func retry(ctx context.Context, op operation, fn func(ctx context.Context) error) error {
+	policy := currentRetryPolicy()
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, span := startAttempt(ctx, op.span, attempt)
+		err := fn(attemptCtx)
+		span.End(err)
+		if err == nil {
+			return nil
+		}
+
+		class := op.classify(err)
+		if ctx.Err() != nil {
+			class = ErrorClassCanceled
+		}
+		if !class.Retryable() || attempt >= maxAttempts {
+			return &RetryError{Op: op.what, Attempts: attempt, Class: class, Err: err}
+		}
+
+		backoff := policy.backoff(attempt)
+		if policy.Deadline > 0 && time.Since(start)+backoff > policy.Deadline {
+			op.logger.Warn("Retry deadline reached", "op", op.what, "attempt", attempt, "deadline", policy.Deadline)
+			return &RetryError{Op: op.what, Attempts: attempt, Class: class, Err: err}
+		}
+
+		op.logger.Warn("Failed to "+op.what+", retrying", "attempt", attempt, "class", string(class), "error", err, "backoff", backoff)
+		notifyRetry(ctx, op.hook, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return &RetryError{Op: op.what, Attempts: attempt, Class: ErrorClassCanceled,
+				Err: fmt.Errorf("%w while waiting to retry: %w", context.Cause(ctx), err)}
+		case <-time.After(backoff):
+		}
+	}
+}
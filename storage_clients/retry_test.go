@@ -0,0 +1,214 @@
+package storage_clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withRetryPolicy sets the retry policy for the duration of a test.
+func withRetryPolicy(t *testing.T, policy RetryPolicy) {
+	t.Helper()
+	previous := currentRetryPolicy()
+	SetRetryPolicy(policy)
+	t.Cleanup(func() { SetRetryPolicy(previous) })
+}
+
+func testOperation(classify func(error) ErrorClass) operation {
+	return operation{
+		span:     "test.Call",
+		hook:     "call",
+		what:     "call the test service",
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		classify: classify,
+	}
+}
+
+func TestRetryCancelledDuringBackoff(t *testing.T) {
+	withRetryPolicy(t, RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour})
+	cause := errors.New("interrupted by signal")
+	callErr := errors.New("service unavailable")
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	ctx = WithRetryHook(ctx, func(op string, attempt int, err error) {
+		cancel(cause) // cancel while the retry waits for its backoff
+	})
+	err := retry(ctx, testOperation(func(error) ErrorClass { return ErrorClassServer }), func(ctx context.Context) error {
+		return callErr
+	})
+
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("err = %v (%T), want a *RetryError", err, err)
+	}
+	if retryErr.Class != ErrorClassCanceled || retryErr.Attempts != 1 {
+		t.Errorf("class = %s after %d attempts, want canceled after 1", retryErr.Class, retryErr.Attempts)
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("err = %v, want it to wrap the cancel cause", err)
+	}
+	if !errors.Is(err, callErr) {
+		t.Errorf("err = %v, want it to wrap the error of the last attempt", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	transient := errors.New("connection reset")
+	tests := []struct {
+		name         string
+		policy       RetryPolicy
+		failures     int // calls that fail before one succeeds
+		class        ErrorClass
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"succeeds at once", RetryPolicy{MaxAttempts: 3}, 0, ErrorClassNetwork, 1, false},
+		{"succeeds after retries", RetryPolicy{MaxAttempts: 3}, 2, ErrorClassNetwork, 3, false},
+		{"attempts run out", RetryPolicy{MaxAttempts: 3}, 5, ErrorClassThrottling, 3, true},
+		{"not retryable", RetryPolicy{MaxAttempts: 3}, 5, ErrorClassAuth, 1, true},
+		{"at least one attempt", RetryPolicy{MaxAttempts: 0}, 5, ErrorClassServer, 1, true},
+		{"deadline reached", RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour, Deadline: time.Nanosecond}, 5, ErrorClassServer, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRetryPolicy(t, tt.policy)
+			var retried []int
+			ctx := WithRetryHook(context.Background(), func(op string, attempt int, err error) {
+				retried = append(retried, attempt)
+			})
+			calls := 0
+			err := retry(ctx, testOperation(func(error) ErrorClass { return tt.class }), func(ctx context.Context) error {
+				calls++
+				if calls <= tt.failures {
+					return transient
+				}
+				return nil
+			})
+
+			if calls != tt.wantAttempts {
+				t.Errorf("calls = %d, want %d", calls, tt.wantAttempts)
+			}
+			if len(retried) != tt.wantAttempts-1 {
+				t.Errorf("retry hook called for attempts %v, want %d calls", retried, tt.wantAttempts-1)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				return
+			}
+			var retryErr *RetryError
+			if !errors.As(err, &retryErr) {
+				t.Fatalf("err = %v (%T), want a *RetryError", err, err)
+			}
+			if retryErr.Attempts != tt.wantAttempts || retryErr.Class != tt.class || !errors.Is(err, transient) {
+				t.Errorf("err = %+v, want %d attempts of class %s wrapping the call error", retryErr, tt.wantAttempts, tt.class)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second}, // the shift overflows
+	}
+	for _, tt := range tests {
+		var max time.Duration
+		for i := 0; i < 1000; i++ {
+			d := policy.backoff(tt.attempt)
+			if d < 0 || d > tt.ceiling {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", tt.attempt, d, tt.ceiling)
+			}
+			if d > max {
+				max = d
+			}
+		}
+		// full jitter spreads the delays over the whole range
+		if max < tt.ceiling/2 {
+			t.Errorf("backoff(%d) never above %v in 1000 draws, want up to %v", tt.attempt, max, tt.ceiling)
+		}
+	}
+
+	if d := (RetryPolicy{}).backoff(3); d != 0 {
+		t.Errorf("backoff without delays = %v, want 0", d)
+	}
+}
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   ErrorClass
+	}{
+		{429, ErrorClassThrottling},
+		{503, ErrorClassThrottling},
+		{500, ErrorClassServer},
+		{502, ErrorClassServer},
+		{401, ErrorClassAuth},
+		{403, ErrorClassAuth},
+		{404, ErrorClassNotFound},
+		{408, ErrorClassNetwork},
+		{400, ErrorClassClient},
+		{409, ErrorClassClient},
+		{200, ErrorClassUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyStatus(tt.status); got != tt.want {
+			t.Errorf("classifyStatus(%d) = %s, want %s", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyCommon(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"canceled", context.Canceled, ErrorClassCanceled},
+		{"wrapped canceled", fmt.Errorf("upload part 3: %w", context.Canceled), ErrorClassCanceled},
+		{"deadline", context.DeadlineExceeded, ErrorClassNetwork},
+		{"net error", &net.OpError{Op: "dial", Err: errors.New("no route to host")}, ErrorClassNetwork},
+		{"connection reset", fmt.Errorf("read: %w", syscall.ECONNRESET), ErrorClassNetwork},
+		{"connection refused", syscall.ECONNREFUSED, ErrorClassNetwork},
+		{"broken pipe", syscall.EPIPE, ErrorClassNetwork},
+		{"truncated body", io.ErrUnexpectedEOF, ErrorClassNetwork},
+		{"other", errors.New("something else"), ErrorClassUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyCommon(tt.err); got != tt.want {
+			t.Errorf("%s: classifyCommon(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestErrorClassRetryable(t *testing.T) {
+	retryable := map[ErrorClass]bool{
+		ErrorClassThrottling: true,
+		ErrorClassServer:     true,
+		ErrorClassNetwork:    true,
+		ErrorClassUnknown:    true,
+		ErrorClassAuth:       false,
+		ErrorClassNotFound:   false,
+		ErrorClassClient:     false,
+		ErrorClassCanceled:   false,
+	}
+	for class, want := range retryable {
+		if got := class.Retryable(); got != want {
+			t.Errorf("%s.Retryable() = %v, want %v", class, got, want)
+		}
+	}
+}
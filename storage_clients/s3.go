@@ -5,19 +5,22 @@ package storage_clients
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
-	"runtime"
 	"sort"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"t-sync/tracing"
 )
 
 func init() {
@@ -31,6 +34,11 @@ type S3Uploader struct {
 	client *s3.Client
 	bucket string
 	object string
+	logger *slog.Logger
+
+	// ETag and version of the object once Complete or PutObject succeeded
+	etag      string
+	versionID string
 }
 
 // NewS3Uploader creates a new S3Uploader.
@@ -38,9 +46,6 @@ func NewS3Uploader(bucket, object, authType string) (*S3Uploader, error) {
 	if bucket == "" {
 		return nil, fmt.Errorf("bucket is required")
 	}
-	if object == "" {
-		return nil, fmt.Errorf("object name is required")
-	}
 
 	var credsProvider aws.CredentialsProvider
 	if strings.HasPrefix(authType, "S3_ACCESS_KEYS[") && strings.HasSuffix(authType, "]") {
@@ -55,9 +60,9 @@ func NewS3Uploader(bucket, object, authType string) (*S3Uploader, error) {
 		sessionToken := ""
 		if len(parts) == 3 {
 			sessionToken = parts[2]
-			log.Printf("Using explicit S3 access keys with session token")
+			slog.Info("Using explicit S3 access keys with session token", "provider", "s3")
 		} else {
-			log.Printf("Using explicit S3 access keys")
+			slog.Info("Using explicit S3 access keys", "provider", "s3")
 		}
 		
 		credsProvider = credentials.NewStaticCredentialsProvider(accessKey, secretKey, sessionToken)
@@ -73,99 +78,93 @@ func NewS3Uploader(bucket, object, authType string) (*S3Uploader, error) {
 		}
 	}
 
+	// retries are done by retry() so that every attempt goes through the retry policy, the
+	// rate limiter and the hooks; SDK retries would multiply the attempts
 	client := s3.New(s3.Options{
 		Region:      region,
 		Credentials: credsProvider,
+		HTTPClient:  tracing.WrapClient(awshttp.NewBuildableClient()),
+		Retryer:     aws.NopRetryer{},
 	})
-	log.Printf("S3 (v2 minimal) client created successfully for bucket: %s, object: %s, region: %s", bucket, object, region)
+	logger := slog.With("provider", "s3", "bucket", bucket, "object", object)
+	logger.Info("S3 (v2 minimal) client created successfully", "region", region)
 
 	return &S3Uploader{
 		client: client,
 		bucket: bucket,
 		object: object,
+		logger: logger,
 	}, nil
 }
 
 func (u *S3Uploader) Initiate(ctx context.Context) (string, error) {
-	log.Printf("Initiating multipart upload for bucket: %s, object: %s", u.bucket, u.object)
+	u.logger.Info("Initiating multipart upload")
 	input := &s3.CreateMultipartUploadInput{
 		Bucket: aws.String(u.bucket),
 		Key:    aws.String(u.object),
 	}
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
+	var uploadID string
+	err := retry(ctx, u.operation("s3.CreateMultipartUpload", "initiate", "initiate multipart upload", u.logger), func(ctx context.Context) error {
 		resp, err := u.client.CreateMultipartUpload(ctx, input)
-		if err == nil {
-			uploadID := *resp.UploadId
-			log.Printf("Successfully initiated multipart upload with ID: %s", uploadID)
-			return uploadID, nil
-		}
-
-		lastErr = err
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed to initiate multipart upload: %v. Retrying in %v...", attempt, lastErr, backoff)
-
-			select {
-			case <-ctx.Done():
-				return "", fmt.Errorf("context cancelled while waiting to retry initiate: %v", ctx.Err())
-			case <-time.After(backoff):
-			}
+		if err != nil {
+			return err
 		}
+		uploadID = aws.ToString(resp.UploadId)
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
-
-	return "", fmt.Errorf("failed to initiate multipart upload after 3 attempts: %v", lastErr)
+	u.logger.Info("Successfully initiated multipart upload", "upload_id", uploadID)
+	return uploadID, nil
 }
 
 func (u *S3Uploader) UploadPart(ctx context.Context, uploadID string, partNumber int, data []byte) (string, error) {
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
+	return u.UploadPartFrom(ctx, uploadID, partNumber, bytes.NewReader(data), int64(len(data)))
+}
+
+// UploadPartFrom uploads a part of size bytes read from body, which is read again from
+// the start when an attempt is retried.
+func (u *S3Uploader) UploadPartFrom(ctx context.Context, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	logger := u.logger.With("upload_id", uploadID, "part", partNumber)
+
+	var etag string
+	err := retry(ctx, u.operation("s3.UploadPart", "upload_part", fmt.Sprintf("upload part %d", partNumber), logger), func(ctx context.Context) error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind part %d: %v", partNumber, err)
+		}
 		input := &s3.UploadPartInput{
 			Bucket:        aws.String(u.bucket),
 			Key:           aws.String(u.object),
 			UploadId:      aws.String(uploadID),
 			PartNumber:    aws.Int32(int32(partNumber)),
-			ContentLength: aws.Int64(int64(len(data))),
-			Body:          bytes.NewReader(data),
+			ContentLength: aws.Int64(size),
+			Body:          body,
 		}
-
 		resp, err := u.client.UploadPart(ctx, input)
 		// Explicitly nil the body to help GC, especially if the SDK holds the request object
-		input.Body = nil 
-		
-		if err == nil {
-			if resp.ETag != nil {
-				// Copy the string to ensure we don't hold onto the entire response buffer
-				etag := string([]byte(*resp.ETag))
-				log.Printf("Successfully uploaded part %d with ETag: %s, %d bytes", partNumber, etag, len(data))
-				// Clear body to help GC
-				input.Body = nil
-				runtime.GC() 
-				return etag, nil
-			}
-			lastErr = fmt.Errorf("no ETag returned for part %d", partNumber)
-		} else {
-			lastErr = err
+		input.Body = nil
+		if err != nil {
+			return err
 		}
-
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed for part %d: %v. Retrying in %v...", attempt, partNumber, lastErr, backoff)
-
-			select {
-			case <-ctx.Done():
-				return "", fmt.Errorf("context cancelled while waiting to retry upload part %d: %v", partNumber, ctx.Err())
-			case <-time.After(backoff):
-			}
+		if resp.ETag == nil {
+			return fmt.Errorf("no ETag returned for part %d", partNumber)
 		}
+		// Copy the string to ensure we don't hold onto the entire response buffer
+		etag = string([]byte(*resp.ETag))
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
 
-	return "", fmt.Errorf("failed to upload part %d after 3 attempts: %v", partNumber, lastErr)
+	logger.Debug("Successfully uploaded part", "etag", etag, "bytes", size)
+	return etag, nil
 }
 
 func (u *S3Uploader) Complete(ctx context.Context, uploadID string, etags map[int]string) error {
-	log.Printf("Completing multipart upload %s with %d parts", uploadID, len(etags))
+	u.logger.Info("Completing multipart upload", "upload_id", uploadID, "parts", len(etags))
 
 	var partNums []int
 	for partNum := range etags {
@@ -190,104 +189,111 @@ func (u *S3Uploader) Complete(ctx context.Context, uploadID string, etags map[in
 		},
 	}
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
-		_, err := u.client.CompleteMultipartUpload(ctx, input)
-		if err == nil {
-			log.Printf("Successfully completed multipart upload %s", uploadID)
-			return nil
-		}
-
-		lastErr = err
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed to complete multipart upload %s: %v. Retrying in %v...", attempt, uploadID, lastErr, backoff)
-
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("context cancelled while waiting to retry complete: %v", ctx.Err())
-			case <-time.After(backoff):
-			}
+	logger := u.logger.With("upload_id", uploadID)
+	err := retry(ctx, u.operation("s3.CompleteMultipartUpload", "complete", "complete multipart upload", logger), func(ctx context.Context) error {
+		resp, err := u.client.CompleteMultipartUpload(ctx, input)
+		if err != nil {
+			return err
 		}
+		u.etag, u.versionID = aws.ToString(resp.ETag), aws.ToString(resp.VersionId)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-
-	return fmt.Errorf("failed to complete multipart upload after 3 attempts: %v", lastErr)
+	logger.Info("Successfully completed multipart upload")
+	return nil
 }
 
 func (u *S3Uploader) PutObject(ctx context.Context, data []byte) error {
-	log.Printf("Putting object %s with %d bytes (simple upload)", u.object, len(data))
+	return u.PutObjectFrom(ctx, bytes.NewReader(data), int64(len(data)))
+}
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
+// PutObjectFrom uploads the object in a single request from size bytes read from body,
+// which is read again from the start when an attempt is retried.
+func (u *S3Uploader) PutObjectFrom(ctx context.Context, body io.ReadSeeker, size int64) error {
+	u.logger.Info("Putting object (simple upload)", "bytes", size)
+
+	err := retry(ctx, u.operation("s3.PutObject", "put_object", "put object", u.logger), func(ctx context.Context) error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind object: %v", err)
+		}
 		input := &s3.PutObjectInput{
 			Bucket:        aws.String(u.bucket),
 			Key:           aws.String(u.object),
-			ContentLength: aws.Int64(int64(len(data))),
-			Body:          bytes.NewReader(data),
+			ContentLength: aws.Int64(size),
+			Body:          body,
 		}
-
-		_, err := u.client.PutObject(ctx, input)
+		resp, err := u.client.PutObject(ctx, input)
 		input.Body = nil
-		if err == nil {
-			log.Printf("Successfully put object %s", u.object)
-			return nil
-		}
-
-		lastErr = err
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed to put object %s: %v. Retrying in %v...", attempt, u.object, lastErr, backoff)
-
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("context cancelled while waiting to retry put object: %v", ctx.Err())
-			case <-time.After(backoff):
-			}
+		if err != nil {
+			return err
 		}
+		u.etag, u.versionID = aws.ToString(resp.ETag), aws.ToString(resp.VersionId)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-
-	return fmt.Errorf("failed to put object after 3 attempts: %v", lastErr)
+	u.logger.Info("Successfully put object")
+	return nil
 }
 
 func (u *S3Uploader) Abort(ctx context.Context, uploadID string) error {
-	log.Printf("Aborting multipart upload %s", uploadID)
+	return u.abortUpload(ctx, u.object, uploadID)
+}
+
+// AbortMultipartUpload aborts an upload of any key in the bucket.
+func (u *S3Uploader) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	return u.abortUpload(ctx, key, uploadID)
+}
+
+func (u *S3Uploader) abortUpload(ctx context.Context, key, uploadID string) error {
+	logger := u.logger.With("key", key, "upload_id", uploadID)
+	logger.Info("Aborting multipart upload")
 
 	input := &s3.AbortMultipartUploadInput{
 		Bucket:   aws.String(u.bucket),
-		Key:      aws.String(u.object),
+		Key:      aws.String(key),
 		UploadId: aws.String(uploadID),
 	}
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
+	err := retry(ctx, u.operation("s3.AbortMultipartUpload", "abort", "abort multipart upload", logger), func(ctx context.Context) error {
 		_, err := u.client.AbortMultipartUpload(ctx, input)
-		if err == nil {
-			log.Printf("Successfully aborted multipart upload %s", uploadID)
+		if err != nil && classifyS3Error(err) == ErrorClassNotFound {
+			// NoSuchUpload: it was likely already aborted or completed
+			logger.Info("Multipart upload already aborted or not found")
 			return nil
 		}
-
-		if strings.Contains(err.Error(), "NoSuchUpload") || strings.Contains(err.Error(), "404") {
-			return nil
-		}
-
-		lastErr = err
-		if attempt < 3 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("Attempt %d failed to abort multipart upload %s: %v. Retrying in %v...", attempt, uploadID, lastErr, backoff)
-
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("context cancelled while waiting to retry abort: %v", ctx.Err())
-			case <-time.After(backoff):
-			}
-		}
+		return err
+	})
+	if err != nil {
+		return err
 	}
+	logger.Info("Successfully aborted multipart upload")
+	return nil
+}
 
-	return fmt.Errorf("failed to abort multipart upload after 3 attempts: %v", lastErr)
+// StatObject returns the size and ETag of the object.
+func (u *S3Uploader) StatObject(ctx context.Context) (ObjectStat, error) {
+	var stat ObjectStat
+	err := retry(ctx, u.operation("s3.HeadObject", "head_object", "get object info", u.logger), func(ctx context.Context) error {
+		resp, err := u.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(u.bucket),
+			Key:    aws.String(u.object),
+		})
+		if err != nil {
+			return err
+		}
+		stat = ObjectStat{Size: aws.ToInt64(resp.ContentLength), ETag: aws.ToString(resp.ETag)}
+		return nil
+	})
+	return stat, err
 }
 
-// GetObjectRange retrieves a specific byte range from an object in S3
-func (u *S3Uploader) GetObjectRange(ctx context.Context, startByte, endByte int64) ([]byte, error) {
+// GetObjectRange retrieves the bytes from startByte to endByte, inclusive, of the object.
+// With a non-empty ifMatch the read fails unless the object still has that ETag.
+func (u *S3Uploader) GetObjectRange(ctx context.Context, startByte, endByte int64, ifMatch string) ([]byte, error) {
 	if startByte < 0 {
 		return nil, fmt.Errorf("start byte must be non-negative")
 	}
@@ -296,26 +302,128 @@ func (u *S3Uploader) GetObjectRange(ctx context.Context, startByte, endByte int6
 	}
 
 	rangeHeader := fmt.Sprintf("bytes=%d-%d", startByte, endByte)
-	log.Printf("Getting object range: %s for object %s", rangeHeader, u.object)
+	logger := u.logger.With("range", rangeHeader)
+	logger.Debug("Getting object range")
+
+	var data []byte
+	err := retry(ctx, u.operation("s3.GetObject", "get_object", fmt.Sprintf("get object range %s", rangeHeader), logger), func(ctx context.Context) error {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(u.bucket),
+			Key:    aws.String(u.object),
+			Range:  aws.String(rangeHeader),
+		}
+		if ifMatch != "" {
+			input.IfMatch = aws.String(ifMatch)
+		}
+		resp, err := u.client.GetObject(ctx, input)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
 
-	input := &s3.GetObjectInput{
+		// A connection dropped mid-body fails the attempt, so the range is read again
+		data, err = io.ReadAll(wrapBody(ctx, resp.Body))
+		if err != nil {
+			return fmt.Errorf("failed to read object content: %w", err)
+		}
+		if int64(len(data)) != endByte-startByte+1 {
+			return fmt.Errorf("short read of range %s: got %d bytes: %w", rangeHeader, len(data), io.ErrUnexpectedEOF)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("Successfully retrieved object range", "bytes", len(data))
+	return data, nil
+}
+
+func (u *S3Uploader) operation(span, hook, what string, logger *slog.Logger) operation {
+	return operation{span: span, hook: hook, what: what, logger: logger, classify: classifyS3Error}
+}
+
+// classifyS3Error classifies S3 errors by their error code, falling back to the HTTP status.
+func classifyS3Error(err error) ErrorClass {
+	if class := classifyCommon(err); class == ErrorClassCanceled {
+		return class
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests", "RequestThrottled":
+			return ErrorClassThrottling
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken", "AccountProblem":
+			return ErrorClassAuth
+		case "NoSuchUpload", "NoSuchBucket", "NoSuchKey", "NotFound":
+			return ErrorClassNotFound
+		case "RequestTimeout", "RequestTimeoutException":
+			return ErrorClassNetwork
+		case "InternalError", "ServiceUnavailable":
+			return ErrorClassServer
+		}
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return classifyStatus(respErr.HTTPStatusCode())
+	}
+	return classifyCommon(err)
+}
+
+// ListMultipartUploads lists the in-progress multipart uploads of the bucket whose key starts with prefix.
+func (u *S3Uploader) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	input := &s3.ListMultipartUploadsInput{
 		Bucket: aws.String(u.bucket),
-		Key:    aws.String(u.object),
-		Range:  aws.String(rangeHeader),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
 	}
 
-	resp, err := u.client.GetObject(ctx, input)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get object range: %v", err)
+	var uploads []MultipartUpload
+	for {
+		var resp *s3.ListMultipartUploadsOutput
+		err := retry(ctx, u.operation("s3.ListMultipartUploads", "list_uploads", "list multipart uploads", u.logger), func(ctx context.Context) error {
+			var err error
+			resp, err = u.client.ListMultipartUploads(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list multipart uploads: %v", err)
+		}
+		for _, upload := range resp.Uploads {
+			uploads = append(uploads, MultipartUpload{
+				Key:       aws.ToString(upload.Key),
+				UploadID:  aws.ToString(upload.UploadId),
+				Initiated: aws.ToTime(upload.Initiated),
+			})
+		}
+		if !aws.ToBool(resp.IsTruncated) {
+			return uploads, nil
+		}
+		input.KeyMarker = resp.NextKeyMarker
+		input.UploadIdMarker = resp.NextUploadIdMarker
 	}
-	defer resp.Body.Close()
+}
 
-	data, err := io.ReadAll(resp.Body)
+// CheckAccess makes a lightweight HeadBucket call to validate credentials and bucket access
+// without creating anything.
+func (u *S3Uploader) CheckAccess(ctx context.Context) error {
+	u.logger.Info("Checking access to bucket")
+	err := retry(ctx, u.operation("s3.HeadBucket", "head_bucket", "check bucket access", u.logger), func(ctx context.Context) error {
+		_, err := u.client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(u.bucket),
+		})
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read object content: %v", err)
+		return fmt.Errorf("failed to access bucket %s: %v", u.bucket, err)
 	}
-
-	log.Printf("Successfully retrieved %d bytes from object range", len(data))
-	return data, nil
+	return nil
 }
 
+// ObjectInfo returns the ETag and version ID of the object written by Complete or PutObject.
+func (u *S3Uploader) ObjectInfo() (etag string, versionID string) {
+	return u.etag, u.versionID
+}
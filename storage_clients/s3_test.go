@@ -0,0 +1,45 @@
+//go:build s3
+
+package storage_clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func TestClassifyS3Error(t *testing.T) {
+	responseError := func(status int) error {
+		return &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      errors.New("response error"),
+		}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"slow down", &smithy.GenericAPIError{Code: "SlowDown"}, ErrorClassThrottling},
+		{"access denied", &smithy.GenericAPIError{Code: "AccessDenied"}, ErrorClassAuth},
+		{"expired token", fmt.Errorf("operation error: %w", &smithy.GenericAPIError{Code: "ExpiredToken"}), ErrorClassAuth},
+		{"no such upload", &smithy.GenericAPIError{Code: "NoSuchUpload"}, ErrorClassNotFound},
+		{"request timeout", &smithy.GenericAPIError{Code: "RequestTimeout"}, ErrorClassNetwork},
+		{"internal error", &smithy.GenericAPIError{Code: "InternalError"}, ErrorClassServer},
+		{"status fallback", responseError(503), ErrorClassThrottling},
+		{"forbidden status", responseError(403), ErrorClassAuth},
+		{"canceled", fmt.Errorf("upload part: %w", context.Canceled), ErrorClassCanceled},
+		{"other", errors.New("something else"), ErrorClassUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyS3Error(tt.err); got != tt.want {
+			t.Errorf("%s: classifyS3Error(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
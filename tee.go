@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// what a failed destination does when the archive is written to several of them
+const (
+    DestFailureFail     = "fail"
+    DestFailureContinue = "continue"
+)
+
+// TeeDestination writes a single archive stream to several destinations, so it's only
+// compressed once. Every upload has its own part channel and buffers, and the slowest
+// destination sets the pace. With DestFailureContinue a failed destination is aborted
+// and dropped, and the archive carries on as long as one destination is left.
+type TeeDestination struct {
+    dests   []*Destination
+    failed  []error // set once a destination was dropped or failed the run
+    closed  []bool  // the destination was closed successfully, a local file is already in place
+    policy  string
+    stats   *RunStats
+    multi   bool // more than one destination was given
+    aborted bool
+}
+
+// OpenTeeDestination opens every destination in details. With DestFailureContinue a
+// destination that can't be opened is skipped, otherwise the ones already opened are
+// aborted and the error is returned.
+func OpenTeeDestination(ctx context.Context, details []*DestDetails, cfg *Config, stats *RunStats) (*TeeDestination, error) {
+    t := &TeeDestination{policy: cfg.DestFailure, stats: stats, multi: len(details) > 1}
+    var openErr error
+    for _, detail := range details {
+        dest, err := OpenDestination(ctx, detail, cfg, stats)
+        if err != nil {
+            if cfg.DestFailure == DestFailureContinue && t.multi {
+                slog.Warn("Failed to open destination, continuing with the others", "destination", detail.String(), "error", err)
+                stats.RecordDestinationFailure(detail.String(), err)
+                openErr = err
+                continue
+            }
+            t.Abort(err)
+            t.Wait()
+            return nil, err
+        }
+        t.dests = append(t.dests, dest)
+        t.failed = append(t.failed, nil)
+        t.closed = append(t.closed, false)
+    }
+    if len(t.dests) == 0 {
+        return nil, openErr
+    }
+    return t, nil
+}
+
+// Write implements io.Writer. It fails as soon as one destination fails, unless failed
+// destinations are dropped and others are left.
+func (t *TeeDestination) Write(p []byte) (int, error) {
+    for i, dest := range t.dests {
+        if t.failed[i] != nil {
+            continue
+        }
+        if _, err := dest.Write(p); err != nil {
+            if err := t.drop(i, err); err != nil {
+                return 0, err
+            }
+        }
+    }
+    return len(p), nil
+}
+
+// Close closes every destination that's still written to.
+func (t *TeeDestination) Close() error {
+    for i, dest := range t.dests {
+        if t.failed[i] != nil {
+            continue
+        }
+        if err := dest.Close(); err != nil {
+            if err := t.drop(i, err); err != nil {
+                return err
+            }
+            continue
+        }
+        t.closed[i] = true
+    }
+    return nil
+}
+
+// drop records the failure of destination i. It aborts the destination and returns nil
+// when the archive can go on without it, and returns err otherwise.
+func (t *TeeDestination) drop(i int, err error) error {
+    t.failed[i] = err
+    if t.policy != DestFailureContinue || !t.multi {
+        return err
+    }
+    for _, failed := range t.failed {
+        if failed == nil {
+            slog.Warn("Destination failed, continuing with the others", "destination", t.dests[i].name, "error", err)
+            t.dests[i].Abort(err)
+            return nil
+        }
+    }
+    return err
+}
+
+// Abort aborts every destination that wasn't closed yet. The ones already closed hold
+// the complete archive, so they are kept: a local file stays and an upload is completed.
+func (t *TeeDestination) Abort(cause error) {
+    t.aborted = true
+    for i, dest := range t.dests {
+        if !t.closed[i] {
+            dest.Abort(cause)
+        }
+    }
+}
+
+// Wait waits for every destination. It returns nil when the run succeeded under the
+// failure policy, and otherwise the error of the destination that failed first.
+func (t *TeeDestination) Wait() error {
+    var firstErr, abortErr error
+    var succeeded int
+    for i, dest := range t.dests {
+        err := dest.Wait()
+        switch {
+        case err == nil:
+            succeeded++
+            continue
+        case t.failed[i] == nil && t.aborted && !t.closed[i]:
+            // aborted along with the others, not a failure of its own
+            if abortErr == nil {
+                abortErr = err
+            }
+            continue
+        }
+        if t.multi {
+            if t.failed[i] == nil {
+                slog.Warn("Destination failed", "destination", dest.name, "error", err)
+            }
+            t.stats.RecordDestinationFailure(dest.name, err)
+        }
+        if firstErr == nil {
+            firstErr = err
+        }
+    }
+
+    if firstErr == nil {
+        return abortErr
+    }
+    if t.policy == DestFailureContinue && succeeded > 0 && !t.aborted {
+        slog.Warn("Archive written to some of the destinations only", "succeeded", succeeded, "failed", len(t.dests)-succeeded)
+        return nil
+    }
+    return firstErr
+}
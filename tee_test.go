@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingWriter fails every write, like a full disk.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+    return 0, errors.New("no space left on device")
+}
+
+// testDestinations returns a local file destination under dir for every name, and a
+// destination that fails every write for every name starting with "bad".
+func testDestinations(t *testing.T, dir string, stats *RunStats, names ...string) []*Destination {
+    t.Helper()
+    var dests []*Destination
+    for _, name := range names {
+        if strings.HasPrefix(name, "bad") {
+            dests = append(dests, &Destination{writer: failingWriter{}, name: name, key: name, stats: stats})
+            continue
+        }
+        path := filepath.Join(dir, name)
+        file, err := createPartialFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        dests = append(dests, &Destination{writer: file, file: file, name: "file://" + path, key: path, stats: stats})
+    }
+    return dests
+}
+
+func newTestTee(policy string, stats *RunStats, dests []*Destination) *TeeDestination {
+    return &TeeDestination{
+        dests:  dests,
+        failed: make([]error, len(dests)),
+        closed: make([]bool, len(dests)),
+        policy: policy,
+        stats:  stats,
+        multi:  len(dests) > 1,
+    }
+}
+
+func TestTeeDestinationFailurePolicy(t *testing.T) {
+    tests := []struct {
+        name      string
+        policy    string
+        dests     []string
+        wantCode  int
+        wantFiles []string // local files holding the archive at the end
+        wantFails int      // destinations recorded as failed in the run report
+    }{
+        {"all succeed", DestFailureFail, []string{"a.zip", "b.zip"}, 0, []string{"a.zip", "b.zip"}, 0},
+        {"fail stops everything", DestFailureFail, []string{"a.zip", "bad", "b.zip"}, ExitCodeUploadFailed, nil, 1},
+        {"continue keeps the others", DestFailureContinue, []string{"a.zip", "bad", "b.zip"}, 0, []string{"a.zip", "b.zip"}, 1},
+        {"continue fails without any left", DestFailureContinue, []string{"bad1", "bad2"}, ExitCodeUploadFailed, nil, 2},
+        {"continue with a single destination", DestFailureContinue, []string{"bad"}, ExitCodeUploadFailed, nil, 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := t.TempDir()
+            stats := NewRunStats()
+            tee := newTestTee(tt.policy, stats, testDestinations(t, dir, stats, tt.dests...))
+
+            var writeErr error
+            for i := 0; i < 3 && writeErr == nil; i++ {
+                _, writeErr = tee.Write([]byte("archive data "))
+            }
+            code, err := finishDestination(context.Background(), tee, writeErr)
+            if code != tt.wantCode {
+                t.Errorf("exit code = %d (%v), want %d", code, err, tt.wantCode)
+            }
+
+            entries, _ := os.ReadDir(dir)
+            var files []string
+            for _, entry := range entries {
+                files = append(files, entry.Name())
+                data, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
+                if string(data) != "archive data archive data archive data " {
+                    t.Errorf("%s holds %q", entry.Name(), data)
+                }
+            }
+            if len(files) != len(tt.wantFiles) {
+                t.Errorf("files = %q, want %q", files, tt.wantFiles)
+            }
+            if got := len(stats.DestinationFailures()); got != tt.wantFails {
+                t.Errorf("%d destination failures recorded, want %d: %+v", got, tt.wantFails, stats.DestinationFailures())
+            }
+        })
+    }
+}
+
+func TestTeeDestinationAbort(t *testing.T) {
+    cause := errors.New("interrupted")
+
+    t.Run("while writing", func(t *testing.T) {
+        dir := t.TempDir()
+        stats := NewRunStats()
+        tee := newTestTee(DestFailureFail, stats, testDestinations(t, dir, stats, "a.zip", "b.zip"))
+        if _, err := tee.Write([]byte("data")); err != nil {
+            t.Fatal(err)
+        }
+        tee.Abort(cause)
+        if err := tee.Wait(); !errors.Is(err, cause) {
+            t.Errorf("Wait() = %v, want the abort cause", err)
+        }
+        if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+            t.Errorf("%d files left after the abort", len(entries))
+        }
+        // aborted along with the run, not failures of their own
+        if failures := stats.DestinationFailures(); len(failures) != 0 {
+            t.Errorf("destination failures = %+v", failures)
+        }
+    })
+
+    t.Run("after close", func(t *testing.T) {
+        dir := t.TempDir()
+        stats := NewRunStats()
+        tee := newTestTee(DestFailureFail, stats, testDestinations(t, dir, stats, "a.zip", "b.zip"))
+        if _, err := tee.Write([]byte("data")); err != nil {
+            t.Fatal(err)
+        }
+        if err := tee.Close(); err != nil {
+            t.Fatal(err)
+        }
+        // the closed destinations hold the complete archive and are kept
+        tee.Abort(cause)
+        if err := tee.Wait(); err != nil {
+            t.Errorf("Wait() = %v", err)
+        }
+        for _, name := range []string{"a.zip", "b.zip"} {
+            if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != "data" {
+                t.Errorf("%s = %q, %v", name, data, err)
+            }
+        }
+        if objects := stats.Objects(); len(objects) != 2 {
+            t.Errorf("%d objects recorded, want 2", len(objects))
+        }
+    })
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"net/http"
+)
+
+// HTTPDoer is the HTTP client interface of both the AWS and the OCI SDKs.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type tracedClient struct {
+	next HTTPDoer
+}
+
+// WrapClient returns a client that records a span for every request made with a traced
+// context and propagates the trace to the server with a W3C traceparent header.
+func WrapClient(next HTTPDoer) HTTPDoer {
+	return &tracedClient{next: next}
+}
+
+func (c *tracedClient) Do(req *http.Request) (*http.Response, error) {
+	if FromContext(req.Context()) == nil {
+		return c.next.Do(req)
+	}
+
+	ctx, span := StartKind(req.Context(), "HTTP "+req.Method, KindClient,
+		String("http.request.method", req.Method),
+		String("server.address", req.URL.Host),
+		String("url.path", req.URL.Path),
+	)
+	if span == nil {
+		return c.next.Do(req)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("traceparent", span.TraceParent())
+
+	resp, err := c.next.Do(req)
+	if err != nil {
+		span.End(err)
+		return resp, err
+	}
+	span.SetAttributes(Int("http.response.status_code", int64(resp.StatusCode)))
+	if resp.StatusCode >= 500 {
+		span.End(httpStatusError(resp.Status))
+	} else {
+		span.End(nil)
+	}
+	return resp, nil
+}
+
+type httpStatusError string
+
+func (e httpStatusError) Error() string { return string(e) }
@@ -0,0 +1,349 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	traceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	spanIDPattern  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// collector is an OTLP/HTTP receiver that keeps the decoded export requests.
+type collector struct {
+	mu       sync.Mutex
+	requests []map[string]interface{}
+	headers  []http.Header
+	paths    []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req map[string]interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.requests = append(c.requests, req)
+	c.headers = append(c.headers, r.Header.Clone())
+	c.paths = append(c.paths, r.URL.Path)
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+// checkKeys fails when obj has a field that isn't in allowed, or misses one of required.
+func checkKeys(t *testing.T, what string, obj map[string]interface{}, required []string, allowed ...string) {
+	t.Helper()
+	known := make(map[string]bool)
+	for _, key := range append(required, allowed...) {
+		known[key] = true
+	}
+	for key := range obj {
+		if !known[key] {
+			t.Errorf("%s has the unknown field %q", what, key)
+		}
+	}
+	for _, key := range required {
+		if _, ok := obj[key]; !ok {
+			t.Errorf("%s misses the field %q", what, key)
+		}
+	}
+}
+
+// checkAttributes validates a list of OTLP KeyValue and returns the values by key.
+func checkAttributes(t *testing.T, what string, raw interface{}) map[string]interface{} {
+	t.Helper()
+	values := make(map[string]interface{})
+	if raw == nil {
+		return values
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		t.Fatalf("%s attributes are %T, want an array", what, raw)
+	}
+	for _, item := range list {
+		attr := item.(map[string]interface{})
+		checkKeys(t, what+" attribute", attr, []string{"key", "value"})
+		key, _ := attr["key"].(string)
+		value, _ := attr["value"].(map[string]interface{})
+		if len(value) != 1 {
+			t.Fatalf("%s attribute %s has value %v, want exactly one of the AnyValue fields", what, key, attr["value"])
+		}
+		for kind, v := range value {
+			switch kind {
+			case "stringValue":
+				if _, ok := v.(string); !ok {
+					t.Errorf("%s attribute %s: stringValue is %T", what, key, v)
+				}
+			case "intValue":
+				// 64 bit integers are strings in the JSON encoding
+				s, ok := v.(string)
+				if _, err := strconv.ParseInt(s, 10, 64); !ok || err != nil {
+					t.Errorf("%s attribute %s: intValue %v isn't a decimal string", what, key, v)
+				}
+			case "doubleValue":
+				if _, ok := v.(float64); !ok {
+					t.Errorf("%s attribute %s: doubleValue is %T", what, key, v)
+				}
+			case "boolValue":
+				if _, ok := v.(bool); !ok {
+					t.Errorf("%s attribute %s: boolValue is %T", what, key, v)
+				}
+			default:
+				t.Errorf("%s attribute %s has the unknown value type %s", what, key, kind)
+			}
+			values[key] = v
+		}
+	}
+	return values
+}
+
+// exportedSpan is a span of an export request, checked against the OTLP schema.
+type exportedSpan struct {
+	traceID, spanID, parentSpanID string
+	kind                          int
+	attrs                         map[string]interface{}
+	statusCode                    int
+	statusMessage                 string
+}
+
+// checkRequest validates an ExportTraceServiceRequest and returns its spans by name.
+func checkRequest(t *testing.T, req map[string]interface{}, serviceName string) map[string]exportedSpan {
+	t.Helper()
+	checkKeys(t, "request", req, []string{"resourceSpans"})
+	spans := make(map[string]exportedSpan)
+	for _, rs := range req["resourceSpans"].([]interface{}) {
+		resourceSpans := rs.(map[string]interface{})
+		checkKeys(t, "resourceSpans", resourceSpans, []string{"resource", "scopeSpans"}, "schemaUrl")
+		resource := resourceSpans["resource"].(map[string]interface{})
+		checkKeys(t, "resource", resource, []string{"attributes"}, "droppedAttributesCount")
+		if got := checkAttributes(t, "resource", resource["attributes"])["service.name"]; got != serviceName {
+			t.Errorf("service.name = %v, want %s", got, serviceName)
+		}
+
+		for _, ss := range resourceSpans["scopeSpans"].([]interface{}) {
+			scopeSpans := ss.(map[string]interface{})
+			checkKeys(t, "scopeSpans", scopeSpans, []string{"scope", "spans"}, "schemaUrl")
+			scope := scopeSpans["scope"].(map[string]interface{})
+			checkKeys(t, "scope", scope, []string{"name"}, "version", "attributes", "droppedAttributesCount")
+
+			for _, s := range scopeSpans["spans"].([]interface{}) {
+				span := s.(map[string]interface{})
+				name, _ := span["name"].(string)
+				checkKeys(t, "span "+name, span,
+					[]string{"traceId", "spanId", "name", "kind", "startTimeUnixNano", "endTimeUnixNano", "status"},
+					"parentSpanId", "traceState", "flags", "attributes", "droppedAttributesCount", "events",
+					"droppedEventsCount", "links", "droppedLinksCount")
+
+				got := exportedSpan{
+					traceID: span["traceId"].(string),
+					spanID:  span["spanId"].(string),
+					attrs:   checkAttributes(t, "span "+name, span["attributes"]),
+				}
+				if !traceIDPattern.MatchString(got.traceID) || got.traceID == "00000000000000000000000000000000" {
+					t.Errorf("span %s: invalid traceId %q", name, got.traceID)
+				}
+				if !spanIDPattern.MatchString(got.spanID) {
+					t.Errorf("span %s: invalid spanId %q", name, got.spanID)
+				}
+				if parent, ok := span["parentSpanId"]; ok {
+					got.parentSpanID, _ = parent.(string)
+					if !spanIDPattern.MatchString(got.parentSpanID) {
+						t.Errorf("span %s: invalid parentSpanId %q", name, got.parentSpanID)
+					}
+				}
+
+				kind, ok := span["kind"].(float64)
+				if !ok || kind < 0 || kind > 5 || kind != float64(int(kind)) {
+					t.Errorf("span %s: invalid kind %v", name, span["kind"])
+				}
+				got.kind = int(kind)
+
+				start, startErr := strconv.ParseUint(span["startTimeUnixNano"].(string), 10, 64)
+				end, endErr := strconv.ParseUint(span["endTimeUnixNano"].(string), 10, 64)
+				if startErr != nil || endErr != nil || start == 0 || end < start {
+					t.Errorf("span %s: invalid times %v..%v", name, span["startTimeUnixNano"], span["endTimeUnixNano"])
+				}
+
+				status := span["status"].(map[string]interface{})
+				checkKeys(t, "span "+name+" status", status, nil, "code", "message")
+				if code, ok := status["code"]; ok {
+					c, _ := code.(float64)
+					if c < 0 || c > 2 {
+						t.Errorf("span %s: invalid status code %v", name, code)
+					}
+					got.statusCode = int(c)
+				}
+				got.statusMessage, _ = status["message"].(string)
+
+				spans[name] = got
+			}
+		}
+	}
+	return spans
+}
+
+func TestExportedSpansMatchOTLPSchema(t *testing.T) {
+	coll := &collector{}
+	collectorServer := httptest.NewServer(coll)
+	defer collectorServer.Close()
+
+	var traceparent string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer storage.Close()
+
+	exporter, err := Setup(collectorServer.URL+"/", "t-sync-test", map[string]string{"Authorization": "Bearer token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, root := Start(context.Background(), "archive", String("destination", "s3://bucket/key"), Int("sources", 2))
+	child, part := Start(ctx, "upload_part", Int("part", 3), Bool("retried", true), Attr{Key: "ratio", Value: 0.5})
+	req, _ := http.NewRequestWithContext(child, http.MethodPut, storage.URL+"/bucket/key", nil)
+	resp, err := WrapClient(http.DefaultClient).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	part.End(errors.New("part failed"))
+	root.End(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := exporter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if Enabled() {
+		t.Error("still enabled after Shutdown")
+	}
+
+	if len(coll.requests) != 1 {
+		t.Fatalf("collector got %d requests, want 1", len(coll.requests))
+	}
+	if coll.paths[0] != "/v1/traces" {
+		t.Errorf("path = %s, want /v1/traces", coll.paths[0])
+	}
+	if got := coll.headers[0].Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := coll.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q", got)
+	}
+
+	spans := checkRequest(t, coll.requests[0], "t-sync-test")
+	if len(spans) != 3 {
+		t.Fatalf("got spans %v, want archive, upload_part and HTTP PUT", reflect.ValueOf(spans).MapKeys())
+	}
+	archive, uploadPart, httpSpan := spans["archive"], spans["upload_part"], spans["HTTP PUT"]
+
+	if archive.parentSpanID != "" || archive.kind != KindInternal || archive.statusCode != statusUnset {
+		t.Errorf("archive span = %+v, want an internal root span without status", archive)
+	}
+	if archive.attrs["destination"] != "s3://bucket/key" || archive.attrs["sources"] != "2" {
+		t.Errorf("archive attributes = %v", archive.attrs)
+	}
+	if uploadPart.traceID != archive.traceID || uploadPart.parentSpanID != archive.spanID {
+		t.Errorf("upload_part span isn't a child of archive: %+v", uploadPart)
+	}
+	if uploadPart.statusCode != statusError || uploadPart.statusMessage != "part failed" {
+		t.Errorf("upload_part status = %d %q, want an error", uploadPart.statusCode, uploadPart.statusMessage)
+	}
+	if uploadPart.attrs["part"] != "3" || uploadPart.attrs["retried"] != true || uploadPart.attrs["ratio"] != 0.5 {
+		t.Errorf("upload_part attributes = %v", uploadPart.attrs)
+	}
+	if httpSpan.kind != KindClient || httpSpan.parentSpanID != uploadPart.spanID || httpSpan.statusCode != statusError {
+		t.Errorf("HTTP span = %+v, want a failed client span below upload_part", httpSpan)
+	}
+	if httpSpan.attrs["http.response.status_code"] != "503" {
+		t.Errorf("HTTP span attributes = %v", httpSpan.attrs)
+	}
+	if want := "00-" + httpSpan.traceID + "-" + httpSpan.spanID + "-01"; traceparent != want {
+		t.Errorf("traceparent = %q, want %q", traceparent, want)
+	}
+}
+
+func TestSpansAreNoOpsWithoutSetup(t *testing.T) {
+	ctx, span := Start(context.Background(), "walk")
+	if span != nil || FromContext(ctx) != nil {
+		t.Fatal("Start recorded a span without an exporter")
+	}
+	// the methods of a nil span are safe to call
+	span.SetAttributes(String("k", "v"))
+	span.End(errors.New("ignored"))
+	if span.TraceParent() != "" || span.TraceID() != "" {
+		t.Error("nil span has trace IDs")
+	}
+}
+
+func TestSetupEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantURL  string
+		wantErr  bool
+	}{
+		{"http://localhost:4318", "http://localhost:4318/v1/traces", false},
+		{"http://localhost:4318/", "http://localhost:4318/v1/traces", false},
+		{"https://otel.example.com/v1/traces", "https://otel.example.com/v1/traces", false},
+		{"localhost:4318", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			exporter, err := Setup(tt.endpoint, "t-sync", nil)
+			if tt.wantErr {
+				if err == nil {
+					exporter.Shutdown(context.Background())
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer exporter.Shutdown(context.Background())
+			if exporter.url != tt.wantURL {
+				t.Errorf("url = %s, want %s", exporter.url, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"api-key=secret", map[string]string{"api-key": "secret"}, false},
+		{" a = 1 , b=2=3,", map[string]string{"a": "1", "b": "2=3"}, false},
+		{"novalue", nil, true},
+		{"=value", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseHeaders(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Package tracing is a small OpenTelemetry compatible tracer. Spans are exported in the
+// OTLP/HTTP JSON encoding, which every OpenTelemetry collector accepts, so the binary does
+// not need the OpenTelemetry SDK and its gRPC and protobuf dependencies.
+//
+// Until Setup is called every function is a no-op and Start returns a nil *Span, whose
+// methods are safe to call.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Span kinds, as numbered by OTLP.
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// OTLP status codes.
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+var active atomic.Pointer[Exporter]
+
+// Attr is a span attribute. Value is a string, int64, float64 or bool.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attr { return Attr{Key: key, Value: value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int64) Attr { return Attr{Key: key, Value: value} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attr { return Attr{Key: key, Value: value} }
+
+// Span is a single timed operation of a trace.
+type Span struct {
+	exporter *Exporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu            sync.Mutex
+	end           time.Time
+	attrs         []Attr
+	statusCode    int
+	statusMessage string
+	ended         bool
+}
+
+type spanKey struct{}
+
+// Enabled reports whether spans are being recorded.
+func Enabled() bool {
+	return active.Load() != nil
+}
+
+// Start starts a span as a child of the span in ctx, if any, and returns a context
+// carrying the new span.
+func Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal, attrs...)
+}
+
+// StartKind is Start with an explicit span kind.
+func StartKind(ctx context.Context, name string, kind int, attrs ...Attr) (context.Context, *Span) {
+	exporter := active.Load()
+	if exporter == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		exporter: exporter,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    attrs,
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. A non-nil err marks the span as failed.
+// Only the first call has an effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if err != nil {
+		s.statusCode = statusError
+		s.statusMessage = err.Error()
+	}
+	s.mu.Unlock()
+	s.exporter.enqueue(s)
+}
+
+// TraceParent returns the W3C traceparent header value for the span.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// TraceID returns the hex encoded trace ID of the span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
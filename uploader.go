@@ -3,27 +3,102 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"os"
 	"sync"
+	"time"
 
 	"t-sync/storage_clients"
+	"t-sync/tracing"
 )
 
-// Part represents a chunk of the file to be uploaded.
+// Part represents a chunk of the file to be uploaded, held in memory or spooled to disk.
 type Part struct {
     Number int
-    Data   []byte
+    Data   []byte   // in memory part, nil when spooled
+    File   *os.File // spooled part, nil when in memory
+    Size   int64    // size of File
+    pool   *partPool  // owner of Data, nil if it isn't pooled
+    spool  *partSpool // owner of File
 }
 
-// ObjectStorageUploader defines the interface for a multipart upload.
+// Len returns the size of the part in bytes.
+func (p Part) Len() int {
+    if p.File != nil {
+        return int(p.Size)
+    }
+    return len(p.Data)
+}
+
+// reader returns the data of the part without copying it.
+func (p Part) reader() io.ReadSeeker {
+    if p.File != nil {
+        return io.NewSectionReader(p.File, 0, p.Size)
+    }
+    return bytes.NewReader(p.Data)
+}
+
+// Release returns the buffer of the part to its pool, or deletes its spool file, once
+// the part is uploaded or given up on. The part must not be used afterwards.
+func (p Part) Release() {
+    switch {
+    case p.pool != nil:
+        p.pool.put(p.Data)
+    case p.spool != nil:
+        p.spool.release(p.File)
+    }
+}
+
+// UploadOptions controls how the parts of an object are uploaded.
+type UploadOptions struct {
+    Concurrency int               // parts uploaded at the same time, the maximum when auto-tuning
+    AutoTune    bool              // adjust the concurrency to the observed throughput and part latency
+    Limiter     *BandwidthLimiter // shared by all uploads, nil for unlimited
+}
+
+// ObjectStorageUploader defines the interface for a multipart upload. Parts and objects
+// can be uploaded from memory or streamed from a reader of known length, e.g. a spool
+// file. A reader is read again from the start when an attempt is retried. Streams of
+// unknown length, like stdin, go through a channelWriter: both S3 and the OCI SDK need
+// the length of a request body up front.
 type ObjectStorageUploader interface {
     Initiate(ctx context.Context) (uploadID string, err error)
     UploadPart(ctx context.Context, uploadID string, partNumber int, data []byte) (etag string, err error)
+    UploadPartFrom(ctx context.Context, uploadID string, partNumber int, body io.ReadSeeker, size int64) (etag string, err error)
     Complete(ctx context.Context, uploadID string, etags map[int]string) error
     Abort(ctx context.Context, uploadID string) error
 
     PutObject(ctx context.Context, data []byte) error
+    PutObjectFrom(ctx context.Context, body io.ReadSeeker, size int64) error
+}
+
+// AccessChecker is implemented by uploaders that can validate credentials and bucket
+// access with a cheap call, without starting an upload.
+type AccessChecker interface {
+    CheckAccess(ctx context.Context) error
+}
+
+// ObjectInfoProvider is implemented by uploaders that remember the ETag and version
+// of the object written by Complete or PutObject.
+type ObjectInfoProvider interface {
+    ObjectInfo() (etag string, versionID string)
+}
+
+// MultipartUploadManager is implemented by uploaders that can list and abort the
+// in-progress multipart uploads of their bucket, see the cleanup command.
+type MultipartUploadManager interface {
+    ListMultipartUploads(ctx context.Context, prefix string) ([]storage_clients.MultipartUpload, error)
+    AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
+
+// ObjectDownloader is implemented by clients that can read an object back in ranges, see
+// the get command.
+type ObjectDownloader interface {
+    StatObject(ctx context.Context) (storage_clients.ObjectStat, error)
+    GetObjectRange(ctx context.Context, startByte, endByte int64, ifMatch string) ([]byte, error)
 }
 
 // NewUploader is a factory function that returns an uploader based on the provider.
@@ -41,114 +116,288 @@ func NewUploader(details *DestDetails, authType string) (ObjectStorageUploader,
     return nil, fmt.Errorf("internal error: registered uploader for '%s' does not implement ObjectStorageUploader interface", details.Provider)
 }
 
-// channelWriter is an io.Writer that writes to a channel of parts.
+// errUploadStopped is returned by channelWriter once the upload goroutine has stopped
+// reading parts, e.g. after a failed part.
+var errUploadStopped = errors.New("upload stopped")
+
+// channelWriter is an io.Writer that writes to a channel of parts. Data is copied once,
+// into a buffer of the pool or a spool file, which is handed to the upload.
 type channelWriter struct {
     partChan    chan<- Part
-    buffer      *bytes.Buffer
+    done        <-chan struct{} // closed when the upload goroutine returns
+    pool        *partPool
+    current     []byte // part being filled, nil until the first write
+    spool       *partSpool // set when parts are spooled to disk instead of the pool
+    spooled     *spoolFile // spooled part being filled
     minPartSize int
     partNumber  int
+    closed      bool
 }
 
-// NewChannelWriter creates a new channelWriter.
-func NewChannelWriter(partChan chan<- Part, minPartSize int) *channelWriter {
-    return &channelWriter{
+// NewChannelWriter creates a new channelWriter. done is closed when the consumer of
+// partChan stops, so a blocked Write returns instead of waiting forever. At most
+// maxParts parts of minPartSize bytes exist at the same time, including the one being
+// filled. They are held in memory, or in files when spool is set.
+func NewChannelWriter(partChan chan<- Part, done <-chan struct{}, minPartSize int, maxParts int, spool *partSpool) *channelWriter {
+    cw := &channelWriter{
         partChan:    partChan,
-        buffer:      &bytes.Buffer{},
+        done:        done,
+        spool:       spool,
         minPartSize: minPartSize,
         partNumber:  1,
     }
+    if spool == nil {
+        cw.pool = newPartPool(maxParts, minPartSize)
+    }
+    return cw
 }
 
-// Write implements the io.Writer interface.
+func (cw *channelWriter) send(part Part) error {
+    select {
+    case <-cw.done:
+        return errUploadStopped
+    default:
+    }
+    select {
+    case cw.partChan <- part:
+        return nil
+    case <-cw.done:
+        return errUploadStopped
+    }
+}
+
+// flush sends the part being filled as the next part.
+func (cw *channelWriter) flush() error {
+    var part Part
+    if cw.spooled != nil {
+        if err := cw.spooled.finish(); err != nil {
+            return err
+        }
+        part = Part{Number: cw.partNumber, File: cw.spooled.file, Size: cw.spooled.size, spool: cw.spool}
+        cw.spooled = nil
+    } else {
+        part = Part{Number: cw.partNumber, Data: cw.current, pool: cw.pool}
+        cw.current = nil
+    }
+    if err := cw.send(part); err != nil {
+        return err
+    }
+    cw.partNumber++
+    return nil
+}
+
+// Write implements the io.Writer interface. It blocks while all the buffers of the pool,
+// or all the spool files, are queued or being uploaded.
 func (cw *channelWriter) Write(p []byte) (n int, err error) {
-    cw.buffer.Write(p)
-    for cw.buffer.Len() >= cw.minPartSize {
-        partData := make([]byte, cw.minPartSize)
-        _, err := cw.buffer.Read(partData)
-        if err != nil {
-            return 0, err // Should not happen
+    if cw.spool != nil {
+        return cw.writeSpooled(p)
+    }
+    for n < len(p) {
+        if cw.current == nil {
+            if cw.current = cw.pool.get(cw.done); cw.current == nil {
+                return n, errUploadStopped
+            }
         }
+        copied := copy(cw.current[len(cw.current):cw.minPartSize], p[n:])
+        cw.current = cw.current[:len(cw.current)+copied]
+        n += copied
 
-        cw.partChan <- Part{
-            Number: cw.partNumber,
-            Data:   partData,
+        if len(cw.current) == cw.minPartSize {
+            if err := cw.flush(); err != nil {
+                return n, err
+            }
         }
-        cw.partNumber++
     }
-    return len(p), nil
+    return n, nil
+}
+
+func (cw *channelWriter) writeSpooled(p []byte) (n int, err error) {
+    for n < len(p) {
+        if cw.spooled == nil {
+            if cw.spooled, err = cw.spool.create(cw.done); err != nil {
+                return n, err
+            }
+            if cw.spooled == nil {
+                return n, errUploadStopped
+            }
+        }
+        chunk := p[n:]
+        if room := int64(cw.minPartSize) - cw.spooled.size; int64(len(chunk)) > room {
+            chunk = chunk[:room]
+        }
+        if err := cw.spooled.write(chunk); err != nil {
+            return n, err
+        }
+        n += len(chunk)
+
+        if cw.spooled.size == int64(cw.minPartSize) {
+            if err := cw.flush(); err != nil {
+                return n, err
+            }
+        }
+    }
+    return n, nil
 }
 
 // Close flushes any remaining data in the buffer as the last part.
 func (cw *channelWriter) Close() error {
-    if cw.buffer.Len() > 0 {
-        partData := cw.buffer.Bytes()
-        cw.partChan <- Part{
-            Number: cw.partNumber,
-            Data:   partData,
-        }
+    if cw.closed {
+        return nil
     }
+    var err error
+    if len(cw.current) > 0 || (cw.spooled != nil && cw.spooled.size > 0) {
+        err = cw.flush()
+    }
+    cw.closed = true
     close(cw.partChan)
-    return nil
+    return err
+}
+
+// removeSpool deletes the spool files left behind by an aborted upload. It is called
+// once neither the archive nor the upload uses them anymore.
+func (cw *channelWriter) removeSpool() {
+    if cw.spool == nil {
+        return
+    }
+    if cw.spooled != nil {
+        cw.spooled.file.Close()
+    }
+    if err := cw.spool.remove(); err != nil {
+        slog.Warn("Failed to remove spool directory", "dir", cw.spool.dir, "error", err)
+    }
+}
+
+// abort closes the part channel without sending the buffered data.
+func (cw *channelWriter) abort() {
+    if !cw.closed {
+        cw.closed = true
+        close(cw.partChan)
+    }
+}
+
+// objectResult fills in what the uploader knows about the object it just wrote.
+func objectResult(uploader ObjectStorageUploader, result ObjectResult) ObjectResult {
+    if info, ok := uploader.(ObjectInfoProvider); ok {
+        result.ETag, result.VersionID = info.ObjectInfo()
+    }
+    return result
+}
+
+// abortTimeout bounds the Abort call once the upload has failed or was interrupted.
+const abortTimeout = 2 * time.Minute
+
+// receivePart reads the next part, or returns false when the channel is closed or ctx is done.
+func receivePart(ctx context.Context, partChan <-chan Part) (Part, bool) {
+    select {
+    case part, ok := <-partChan:
+        return part, ok
+    case <-ctx.Done():
+        return Part{}, false
+    }
 }
 
-func uploadToObjectStorage(parentCtx context.Context, uploader ObjectStorageUploader, partChan <-chan Part, uploadWg *sync.WaitGroup, concurrency int) error {
+func uploadToObjectStorage(parentCtx context.Context, uploader ObjectStorageUploader, partChan <-chan Part, uploadWg *sync.WaitGroup, opts UploadOptions, stats *RunStats) (result ObjectResult, err error) {
     defer uploadWg.Done()
 
+    stats.StageStart("upload")
+    defer stats.StageEnd("upload")
+
+    parentCtx, span := tracing.Start(parentCtx, "upload")
+    defer func() {
+        span.SetAttributes(tracing.Int("parts", int64(result.Parts)), tracing.Int("bytes", result.Bytes))
+        if result.UploadID != "" {
+            span.SetAttributes(tracing.String("upload_id", result.UploadID))
+        }
+        span.End(err)
+    }()
+
     // Create a new context that can be cancelled if an error occurs
     ctx, cancel := context.WithCancel(parentCtx)
     defer cancel() // Ensure cancel is called to free resources
+    ctx = storage_clients.WithRetryHook(ctx, func(op string, attempt int, err error) {
+        stats.Retry()
+    })
 
     // Read the first part to decide on the upload strategy
-    part1, ok := <-partChan
+    part1, ok := receivePart(ctx, partChan)
+    if ctx.Err() != nil {
+        return ObjectResult{}, context.Cause(ctx)
+    }
     if !ok {
-        log.Println("No data to upload.")
-        return nil
+        slog.Warn("No data to upload")
+        return ObjectResult{}, nil
     }
 
     // Check for a second part to determine if multipart is needed
-    part2, ok := <-partChan
+    part2, ok := receivePart(ctx, partChan)
+    if ctx.Err() != nil {
+        // the archive was aborted, don't write a truncated object
+        return ObjectResult{}, context.Cause(ctx)
+    }
     if !ok {
         // Only one part exists, so use a simple upload
-        log.Printf("Total size is %d bytes. Using simple upload.", len(part1.Data))
-        if err := uploader.PutObject(ctx, part1.Data); err != nil {
-            return fmt.Errorf("failed to put object: %v", err)
+        slog.Info("Using simple upload", "bytes", part1.Len())
+        stats.PartStarted()
+        putStart := time.Now()
+        putCtx, putSpan := tracing.Start(ctx, "PutObject", tracing.Int("bytes", int64(part1.Len())))
+        err := uploader.PutObjectFrom(putCtx, opts.Limiter.LimitReadSeeker(putCtx, part1.reader()), int64(part1.Len()))
+        putSpan.End(err)
+        part1.Release()
+        stats.ObservePartLatency(time.Since(putStart))
+        if err != nil {
+            stats.PartFinished(part1.Len(), false)
+            return ObjectResult{}, fmt.Errorf("failed to put object: %w", err)
         }
-        fmt.Println("Upload completed successfully.")
-        return nil
+        stats.PartFinished(part1.Len(), true)
+        slog.Info("Upload completed successfully")
+        return objectResult(uploader, ObjectResult{Parts: 1, Bytes: int64(part1.Len())}), nil
     }
 
     // If we're here, we have at least two parts, so we do a multipart upload
-    log.Println("Data size is large, using multipart upload.")
-    uploadID, err := uploader.Initiate(ctx)
+    slog.Info("Data size is large, using multipart upload")
+    initCtx, initSpan := tracing.Start(ctx, "Initiate")
+    uploadID, err := uploader.Initiate(initCtx)
+    initSpan.End(err)
     if err != nil {
-        return fmt.Errorf("failed to initiate multipart upload: %v", err)
+        return ObjectResult{}, fmt.Errorf("failed to initiate multipart upload: %w", err)
     }
 
     var etags = make(map[int]string)
+    var totalBytes int64
     var uploadErr error
     var mu sync.Mutex
     var workerWg sync.WaitGroup
 
-    if concurrency <= 0 {
-        concurrency = 10 // Default to 10 if a non-positive value is provided
-    }
-    sem := make(chan struct{}, concurrency)
+    workers := newConcurrencyLimiter(opts.Concurrency, opts.AutoTune)
 
     // uploadPart is a closure that handles uploading a single part
     uploadPart := func(part Part) {
         defer workerWg.Done()
+        defer part.Release()
+        var latency time.Duration
+        var uploaded bool
+        defer func() { workers.release(part.Len(), latency, uploaded) }()
 
         // Check for cancellation before proceeding
         if ctx.Err() != nil {
             return
         }
 
-        etag, err := uploader.UploadPart(ctx, uploadID, part.Number, part.Data)
+        stats.PartStarted()
+        partStart := time.Now()
+        partCtx, partSpan := tracing.Start(ctx, "UploadPart", tracing.Int("part", int64(part.Number)), tracing.Int("bytes", int64(part.Len())))
+        // the body pays for its bandwidth as it is sent, on every attempt
+        etag, err := uploader.UploadPartFrom(partCtx, uploadID, part.Number, opts.Limiter.LimitReadSeeker(partCtx, part.reader()), int64(part.Len()))
+        partSpan.End(err)
+        latency = time.Since(partStart)
+        uploaded = err == nil
+        stats.ObservePartLatency(latency)
+        stats.PartFinished(part.Len(), err == nil)
         if err != nil {
             mu.Lock()
             if uploadErr == nil { // Record the first error
-                uploadErr = fmt.Errorf("failed to upload part %d: %v", part.Number, err)
-                log.Println(uploadErr)
+                uploadErr = fmt.Errorf("failed to upload part %d: %w", part.Number, err)
+                slog.Error("Failed to upload part", "part", part.Number, "upload_id", uploadID, "error", err)
                 cancel() // Cancel the context for all other workers
             }
             mu.Unlock()
@@ -160,22 +409,20 @@ func uploadToObjectStorage(parentCtx context.Context, uploader ObjectStorageUplo
         if _, exists := etags[part.Number]; exists {
             if uploadErr == nil {
                 uploadErr = fmt.Errorf("duplicate part number detected: %d", part.Number)
-                log.Println(uploadErr)
+                slog.Error("Duplicate part number detected", "part", part.Number, "upload_id", uploadID)
                 cancel()
             }
         } else {
             etags[part.Number] = etag
+            totalBytes += int64(part.Len())
         }
         mu.Unlock()
     }
 
-    // Goroutine launcher that respects the semaphore
+    // Goroutine launcher that respects the concurrency limit, the slot is released by uploadPart
     runWorker := func(part Part) {
-        sem <- struct{}{} // Acquire semaphore
-        go func(p Part) {
-            defer func() { <-sem }() // Release semaphore
-            uploadPart(p)
-        }(part)
+        workers.acquire()
+        go uploadPart(part)
     }
 
     // Start processing the first two parts
@@ -184,9 +431,10 @@ func uploadToObjectStorage(parentCtx context.Context, uploader ObjectStorageUplo
     runWorker(part2)
 
     // Process the rest of the parts from the channel
-    for part := range partChan {
-        // Check for cancellation before starting a new worker
-        if ctx.Err() != nil {
+    for {
+        // Stops on cancellation before starting a new worker
+        part, ok := receivePart(ctx, partChan)
+        if !ok {
             break
         }
         workerWg.Add(1)
@@ -195,18 +443,35 @@ func uploadToObjectStorage(parentCtx context.Context, uploader ObjectStorageUplo
 
     workerWg.Wait()
 
+    if uploadErr == nil && ctx.Err() != nil {
+        uploadErr = context.Cause(ctx)
+    }
+
     if uploadErr != nil {
-        log.Printf("An error occurred during upload, aborting: %v", uploadErr)
-        if abortErr := uploader.Abort(parentCtx, uploadID); abortErr != nil { // Use parentCtx for abort
-            log.Printf("failed to abort upload: %v", abortErr)
+        slog.Error("An error occurred during upload, aborting", "upload_id", uploadID, "error", uploadErr)
+        // parentCtx may be cancelled too (e.g. by a signal), the abort must still go through
+        abortCtx, abortCancel := context.WithTimeout(context.WithoutCancel(parentCtx), abortTimeout)
+        abortCtx, abortSpan := tracing.Start(abortCtx, "Abort")
+        abortErr := uploader.Abort(abortCtx, uploadID)
+        abortCancel()
+        abortSpan.End(abortErr)
+        if abortErr != nil {
+            slog.Error("Failed to abort upload", "upload_id", uploadID, "error", abortErr)
         }
-        return uploadErr
+        return ObjectResult{UploadID: uploadID}, uploadErr
     }
 
-    if err := uploader.Complete(ctx, uploadID, etags); err != nil {
-        return fmt.Errorf("failed to complete multipart upload: %v", err)
+    completeCtx, completeSpan := tracing.Start(ctx, "Complete", tracing.Int("parts", int64(len(etags))))
+    err = uploader.Complete(completeCtx, uploadID, etags)
+    completeSpan.End(err)
+    if err != nil {
+        return ObjectResult{UploadID: uploadID}, fmt.Errorf("failed to complete multipart upload: %w", err)
     }
 
-    fmt.Println("Upload completed successfully.")
-    return nil
+    if opts.AutoTune {
+        slog.Info("Upload completed successfully", "upload_id", uploadID, "parts", len(etags), "concurrency", workers.current())
+    } else {
+        slog.Info("Upload completed successfully", "upload_id", uploadID, "parts", len(etags))
+    }
+    return objectResult(uploader, ObjectResult{UploadID: uploadID, Parts: len(etags), Bytes: totalBytes}), nil
 }
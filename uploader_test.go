@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// discardUploader accepts every part without keeping it, after an optional delay
+// standing in for the network.
+type discardUploader struct {
+    delay time.Duration
+    bytes atomic.Int64
+}
+
+func (u *discardUploader) Initiate(ctx context.Context) (string, error) {
+    return "upload", nil
+}
+
+func (u *discardUploader) UploadPart(ctx context.Context, uploadID string, partNumber int, data []byte) (string, error) {
+    return u.UploadPartFrom(ctx, uploadID, partNumber, bytes.NewReader(data), int64(len(data)))
+}
+
+func (u *discardUploader) UploadPartFrom(ctx context.Context, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+    time.Sleep(u.delay)
+    n, err := io.Copy(io.Discard, body)
+    u.bytes.Add(n)
+    return strconv.Itoa(partNumber), err
+}
+
+func (u *discardUploader) Complete(ctx context.Context, uploadID string, etags map[int]string) error {
+    return nil
+}
+
+func (u *discardUploader) Abort(ctx context.Context, uploadID string) error {
+    return nil
+}
+
+func (u *discardUploader) PutObject(ctx context.Context, data []byte) error {
+    return u.PutObjectFrom(ctx, bytes.NewReader(data), int64(len(data)))
+}
+
+func (u *discardUploader) PutObjectFrom(ctx context.Context, body io.ReadSeeker, size int64) error {
+    _, err := u.UploadPartFrom(ctx, "", 1, body, size)
+    return err
+}
+
+// residentBytes returns the resident set size of the process, 0 where /proc isn't available.
+func residentBytes() int64 {
+    data, err := os.ReadFile("/proc/self/statm")
+    if err != nil {
+        return 0
+    }
+    fields := strings.Fields(string(data))
+    if len(fields) < 2 {
+        return 0
+    }
+    pages, err := strconv.ParseInt(fields[1], 10, 64)
+    if err != nil {
+        return 0
+    }
+    return pages * int64(os.Getpagesize())
+}
+
+// BenchmarkChannelWriterMemory streams an archive much larger than the pool through the
+// part pipeline and reports the peak heap and the RSS once the upload is done. Both stay
+// around maxParts × partSize however large the archive is.
+func BenchmarkChannelWriterMemory(b *testing.B) {
+    const (
+        partSize  = 1 << 20
+        maxParts  = 8
+        totalSize = 256 << 20
+    )
+    chunk := make([]byte, 32<<10)
+    for i := range chunk {
+        chunk[i] = byte(i)
+    }
+
+    defer slog.SetDefault(slog.Default())
+    slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+    var peakHeap uint64
+    b.SetBytes(totalSize)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        uploader := &discardUploader{delay: time.Millisecond}
+        partChan := make(chan Part, maxParts)
+        done := make(chan struct{})
+        var uploadWg sync.WaitGroup
+        uploadWg.Add(1)
+        var uploadErr error
+        go func() {
+            defer close(done)
+            _, uploadErr = uploadToObjectStorage(context.Background(), uploader, partChan, &uploadWg, UploadOptions{Concurrency: maxParts}, nil)
+        }()
+
+        stopSampling := make(chan struct{})
+        sampled := make(chan struct{})
+        go func() {
+            defer close(sampled)
+            var ms runtime.MemStats
+            ticker := time.NewTicker(5 * time.Millisecond)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-stopSampling:
+                    return
+                case <-ticker.C:
+                    runtime.ReadMemStats(&ms)
+                    if ms.HeapInuse > peakHeap {
+                        peakHeap = ms.HeapInuse
+                    }
+                }
+            }
+        }()
+
+        cw := NewChannelWriter(partChan, done, partSize, maxParts, nil)
+        for written := 0; written < totalSize; written += len(chunk) {
+            if _, err := cw.Write(chunk); err != nil {
+                b.Fatal(err)
+            }
+        }
+        if err := cw.Close(); err != nil {
+            b.Fatal(err)
+        }
+        <-done
+        close(stopSampling)
+        <-sampled
+        if uploadErr != nil {
+            b.Fatal(uploadErr)
+        }
+        if got := uploader.bytes.Load(); got != totalSize {
+            b.Fatalf("uploaded %d bytes, want %d", got, totalSize)
+        }
+    }
+    b.StopTimer()
+
+    b.ReportMetric(float64(peakHeap)/(1<<20), "peak-heap-MiB")
+    if rss := residentBytes(); rss > 0 {
+        b.ReportMetric(float64(rss)/(1<<20), "rss-MiB")
+    }
+}
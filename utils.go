@@ -2,10 +2,59 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 )
 
+// exitHooks run before exitWithErrorCode terminates the process, e.g. to write the run report.
+var exitHooks []func(code int, message string)
+
+func onExit(hook func(code int, message string)) {
+    exitHooks = append(exitHooks, hook)
+}
+
 func exitWithErrorCode(code int, format string, args ...any) {
-    fmt.Fprintf(os.Stderr, format+"\n", args...)
+    message := fmt.Sprintf(format, args...)
+    slog.Error(message, "exit_code", code)
+    for _, hook := range exitHooks {
+        hook(code, message)
+    }
     os.Exit(code)
 }
+
+var byteSizeUnits = []struct {
+    suffix     string
+    multiplier int64
+}{
+    // longest suffixes first so "MiB" isn't read as "B"
+    {"KiB", KiB}, {"MiB", KiB * KiB}, {"GiB", KiB * KiB * KiB}, {"TiB", KiB * KiB * KiB * KiB},
+    {"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+    {"K", KiB}, {"M", KiB * KiB}, {"G", KiB * KiB * KiB}, {"T", KiB * KiB * KiB * KiB},
+    {"B", 1},
+}
+
+// parseByteSize parses sizes like "512", "100KiB", "1.5GB" or "10M" into bytes.
+// Single letter suffixes are binary (K = KiB), like most unix tools.
+func parseByteSize(value string) (int64, error) {
+    s := strings.TrimSpace(value)
+    multiplier := int64(1)
+    for _, unit := range byteSizeUnits {
+        if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(unit.suffix)) {
+            s = strings.TrimSpace(s[:len(s)-len(unit.suffix)])
+            multiplier = unit.multiplier
+            break
+        }
+    }
+    n, err := strconv.ParseFloat(s, 64)
+    if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+        return 0, fmt.Errorf("invalid size %q", value)
+    }
+    bytes := n * float64(multiplier)
+    if bytes >= math.MaxInt64 {
+        return 0, fmt.Errorf("size %q is too large", value)
+    }
+    return int64(bytes), nil
+}
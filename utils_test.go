@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    int64
+        wantErr bool
+    }{
+        {"0", 0, false},
+        {"512", 512, false},
+        {"512B", 512, false},
+        {"100KiB", 100 * KiB, false},
+        {"100kib", 100 * KiB, false},
+        {"10K", 10 * KiB, false},
+        {"10M", 10 * KiB * KiB, false},
+        {"1.5GB", 1500 * 1000 * 1000, false},
+        {"2 MB", 2 * 1000 * 1000, false},
+        {" 1TiB ", KiB * KiB * KiB * KiB, false},
+        {"", 0, true},
+        {"MiB", 0, true},
+        {"-1", 0, true},
+        {"-1K", 0, true},
+        {"ten", 0, true},
+        {"10X", 0, true},
+        {"NaN", 0, true},
+        {"nanKiB", 0, true},
+        {"Inf", 0, true},
+        {"+Inf", 0, true},
+        {"infinityMB", 0, true},
+        {"1e30", 0, true},
+        {"9000000TiB", 0, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.in, func(t *testing.T) {
+            got, err := parseByteSize(tt.in)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("parseByteSize(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+            }
+            if got != tt.want {
+                t.Errorf("parseByteSize(%q) = %d, want %d", tt.in, got, tt.want)
+            }
+        })
+    }
+}